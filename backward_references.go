@@ -37,6 +37,20 @@ func computeDistanceCode(distance uint, max_distance uint, dist_cache []int) uin
 
 var hasherSearchResultPool sync.Pool
 
+/* Returns the largest distance of a backward reference at |position|, and
+   the static dictionary to search, if any. Within a window's distance of a
+   restart point, references may not reach before the restart point, and no
+   static dictionary references are made: they are encoded as distances
+   beyond the data the decoder has, which one that starts at the restart
+   point sees a different amount of. */
+func backwardReferenceLimit(params *encoderParams, position uint) (uint, *encoderDictionary) {
+	var max_distance uint = brotli_min_size_t(position, maxBackwardLimit(params.lgwin))
+	if position-params.restart < max_distance {
+		return position - params.restart, nil
+	}
+	return max_distance, &params.dictionary
+}
+
 func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte, ringbuffer_mask uint, params *encoderParams, hasher hasherHandle, dist_cache []int, last_insert_len *uint, commands *[]command, num_literals *uint) {
 	var max_backward_limit uint = maxBackwardLimit(params.lgwin)
 	var insert_length uint = *last_insert_len
@@ -69,12 +83,12 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 
 	for position+hasher.HashTypeLength() < pos_end {
 		var max_length uint = pos_end - position
-		var max_distance uint = brotli_min_size_t(position, max_backward_limit)
+		max_distance, dictionary := backwardReferenceLimit(params, position)
 		sr.len = 0
 		sr.len_code_delta = 0
 		sr.distance = 0
 		sr.score = kMinScore
-		hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position, max_length, max_distance, gap, params.dist.max_distance, sr)
+		hasher.FindLongestMatch(dictionary, ringbuffer, ringbuffer_mask, dist_cache, position, max_length, max_distance, gap, params.dist.max_distance, sr)
 		if sr.score > kMinScore {
 			/* Found a match. Let's look for something even better ahead. */
 			var delayed_backward_references_in_row int = 0
@@ -89,8 +103,8 @@ func createBackwardReferences(num_bytes uint, position uint, ringbuffer []byte,
 				sr2.len_code_delta = 0
 				sr2.distance = 0
 				sr2.score = kMinScore
-				max_distance = brotli_min_size_t(position+1, max_backward_limit)
-				hasher.FindLongestMatch(&params.dictionary, ringbuffer, ringbuffer_mask, dist_cache, position+1, max_length, max_distance, gap, params.dist.max_distance, sr2)
+				max_distance, dictionary = backwardReferenceLimit(params, position+1)
+				hasher.FindLongestMatch(dictionary, ringbuffer, ringbuffer_mask, dist_cache, position+1, max_length, max_distance, gap, params.dist.max_distance, sr2)
 				if sr2.score >= sr.score+cost_diff_lazy {
 					/* Ok, let's just write one byte for now and start a match from the
 					   next byte. */
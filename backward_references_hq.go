@@ -373,7 +373,7 @@ func evaluateNode(block_start uint, pos uint, max_backward_limit uint, gap uint,
 func updateNodes(num_bytes uint, block_start uint, pos uint, ringbuffer []byte, ringbuffer_mask uint, params *encoderParams, max_backward_limit uint, starting_dist_cache []int, num_matches uint, matches []backwardMatch, model *zopfliCostModel, queue *startPosQueue, nodes []zopfliNode) uint {
 	var cur_ix uint = block_start + pos
 	var cur_ix_masked uint = cur_ix & ringbuffer_mask
-	var max_distance uint = brotli_min_size_t(cur_ix, max_backward_limit)
+	max_distance, _ := backwardReferenceLimit(params, cur_ix)
 	var max_len uint = num_bytes - pos
 	var max_zopfli_len uint = maxZopfliLen(params)
 	var max_iters uint = maxZopfliCandidates(params)
@@ -643,10 +643,10 @@ func zopfliComputeShortestPath(num_bytes uint, position uint, ringbuffer []byte,
 	initStartPosQueue(&queue)
 	for i = 0; i+hasher.HashTypeLength()-1 < num_bytes; i++ {
 		var pos uint = position + i
-		var max_distance uint = brotli_min_size_t(pos, max_backward_limit)
+		max_distance, dictionary := backwardReferenceLimit(params, pos)
 		var skip uint
 		var num_matches uint
-		num_matches = findAllMatchesH10(hasher, &params.dictionary, ringbuffer, ringbuffer_mask, pos, num_bytes-i, max_distance, gap, params, matches[lz_matches_offset:])
+		num_matches = findAllMatchesH10(hasher, dictionary, ringbuffer, ringbuffer_mask, pos, num_bytes-i, max_distance, gap, params, matches[lz_matches_offset:])
 		if num_matches > 0 && backwardMatchLength(&matches[num_matches-1]) > max_zopfli_len {
 			matches[0] = matches[num_matches-1]
 			num_matches = 1
@@ -690,7 +690,6 @@ func createZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer []
 }
 
 func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer []byte, ringbuffer_mask uint, params *encoderParams, hasher hasherHandle, dist_cache []int, last_insert_len *uint, commands *[]command, num_literals *uint) {
-	var max_backward_limit uint = maxBackwardLimit(params.lgwin)
 	var num_matches []uint32 = make([]uint32, num_bytes)
 	var matches_size uint = 4 * num_bytes
 	var store_end uint
@@ -713,7 +712,7 @@ func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer
 	var new_array []backwardMatch
 	for i = 0; i+hasher.HashTypeLength()-1 < num_bytes; i++ {
 		var pos uint = position + i
-		var max_distance uint = brotli_min_size_t(pos, max_backward_limit)
+		max_distance, dictionary := backwardReferenceLimit(params, pos)
 		var max_length uint = num_bytes - i
 		var num_found_matches uint
 		var cur_match_end uint
@@ -739,7 +738,7 @@ func createHqZopfliBackwardReferences(num_bytes uint, position uint, ringbuffer
 			matches_size = new_size
 		}
 
-		num_found_matches = findAllMatchesH10(hasher.(*h10), &params.dictionary, ringbuffer, ringbuffer_mask, pos, max_length, max_distance, gap, params, matches[cur_match_pos+shadow_matches:])
+		num_found_matches = findAllMatchesH10(hasher.(*h10), dictionary, ringbuffer, ringbuffer_mask, pos, max_length, max_distance, gap, params, matches[cur_match_pos+shadow_matches:])
 		cur_match_end = cur_match_pos + num_found_matches
 		for j = cur_match_pos; j+1 < cur_match_end; j++ {
 			assert(backwardMatchLength(&matches[j]) <= backwardMatchLength(&matches[j+1]))
@@ -6,16 +6,21 @@
 package brotli
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/qydysky/brotli/matchfinder"
@@ -425,7 +430,8 @@ func TestDecodeFuzz(t *testing.T) {
 func TestDecodeTrailingData(t *testing.T) {
 	content := bytes.Repeat([]byte("hello world!"), 100)
 	encoded, _ := Encode(content, WriterOptions{Quality: 5})
-	_, err := Decode(append(encoded, 0))
+	// Hide io.ByteReader, which would leave the trailing data unread.
+	_, err := io.ReadAll(NewReader(struct{ io.Reader }{bytes.NewReader(append(encoded, 0))}))
 	if err == nil {
 		t.Errorf("Expected 'excessive input' error")
 	}
@@ -517,7 +523,1873 @@ func TestErrorReset(t *testing.T) {
 	}
 }
 
+func TestWriterMode(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	font := append([]byte("wOF2"), opticks[:4096]...)
+	binary := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(binary)
+
+	for _, test := range []struct {
+		data     []byte
+		wantMode int
+	}{
+		{opticks, modeText},
+		{font, modeFont},
+		{binary, modeGeneric},
+	} {
+		for _, quality := range []int{1, 5, 9, 11} {
+			out := bytes.Buffer{}
+			w := NewWriterOptions(&out, WriterOptions{Quality: quality, Mode: ModeAuto})
+			if _, err := w.Write(test.data); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if quality > 1 && w.params.mode != test.wantMode {
+				t.Errorf("quality %d: auto mode chose %d, want %d", quality, w.params.mode, test.wantMode)
+			}
+			if err := checkCompressedData(out.Bytes(), test.data); err != nil {
+				t.Errorf("quality %d, auto mode: %v", quality, err)
+			}
+		}
+	}
+
+	for _, mode := range []int{ModeGeneric, ModeText, ModeFont} {
+		encoded, err := Encode(opticks, WriterOptions{Quality: 11, Mode: mode})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if err := checkCompressedData(encoded, opticks); err != nil {
+			t.Errorf("mode %d: %v", mode, err)
+		}
+	}
+}
+
+func TestLargeWindow(t *testing.T) {
+	// A block that repeats after more than 16 MiB can only be matched with a
+	// large window.
+	rnd := rand.New(rand.NewSource(0))
+	block := make([]byte, 1<<20)
+	rnd.Read(block)
+	filler := make([]byte, 17<<20)
+	rnd.Read(filler)
+	input := append(append(append([]byte{}, block...), filler...), block...)
+
+	encoded, err := Encode(input, WriterOptions{Quality: 5, LGWin: 25, LargeWindow: true})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if limit := len(input) - len(block)/2; len(encoded) > limit {
+		t.Errorf("Encode returned %d bytes, want <= %d", len(encoded), limit)
+	}
+
+	_, err = Decode(encoded)
+	if !errors.Is(err, ErrLargeWindow) {
+		t.Errorf("Decode without LargeWindow: got error %v, want %v", err, ErrLargeWindow)
+	}
+
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{LargeWindow: true})
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Decode with LargeWindow: %v", err)
+	}
+	if !bytes.Equal(decoded, input) {
+		t.Errorf("Decoded output doesn't match input")
+	}
+
+	// Regular streams are still accepted by a large window Reader.
+	encoded, _ = Encode(block, WriterOptions{Quality: 5})
+	r.Reset(bytes.NewReader(encoded))
+	if decoded, err = io.ReadAll(r); err != nil || !bytes.Equal(decoded, block) {
+		t.Errorf("Decoding regular stream with LargeWindow: err=%v", err)
+	}
+}
+
+func TestWriterSizeHint(t *testing.T) {
+	input := bytes.Repeat([]byte("<html><body><H1>Hello world</H1></body></html>"), 50000)
+	writeSmall := func(w *Writer) {
+		for p := input; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	out := bytes.Buffer{}
+	w := NewWriterOptions(&out, WriterOptions{Quality: 5})
+	writeSmall(w)
+	if w.params.hasher.type_ == 6 {
+		t.Errorf("without size hint: got hasher type 6; expected a hasher for small inputs")
+	}
+
+	out.Reset()
+	w = NewWriterOptions(&out, WriterOptions{Quality: 5, SizeHint: int64(len(input))})
+	writeSmall(w)
+	if w.params.hasher.type_ != 6 {
+		t.Errorf("with SizeHint: got hasher type %d, want 6", w.params.hasher.type_)
+	}
+	if err := checkCompressedData(out.Bytes(), input); err != nil {
+		t.Error(err)
+	}
+
+	out.Reset()
+	w = NewWriterOptions(&out, WriterOptions{Quality: 4})
+	if err := w.SetSizeHint(int64(len(input))); err != nil {
+		t.Fatalf("SetSizeHint: %v", err)
+	}
+	writeSmall(w)
+	if w.params.hasher.type_ != 54 {
+		t.Errorf("with SetSizeHint: got hasher type %d, want 54", w.params.hasher.type_)
+	}
+	if err := checkCompressedData(out.Bytes(), input); err != nil {
+		t.Error(err)
+	}
+	if err := w.SetSizeHint(100); err == nil {
+		t.Errorf("SetSizeHint after Write: got nil error")
+	}
+
+	out.Reset()
+	w = NewWriterOptions(&out, WriterOptions{Quality: 5, SizeHint: -1})
+	if _, err := w.Write(input); err != errNegativeSizeHint {
+		t.Errorf("Write with negative SizeHint: got %v, want %v", err, errNegativeSizeHint)
+	}
+	if err := w.Close(); err != errNegativeSizeHint {
+		t.Errorf("Close with negative SizeHint: got %v, want %v", err, errNegativeSizeHint)
+	}
+	if err := w.SetSizeHint(-1); err != errNegativeSizeHint {
+		t.Errorf("SetSizeHint(-1): got %v, want %v", err, errNegativeSizeHint)
+	}
+}
+
+func TestWriterLGBlock(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lgblock := range []int{0, 16, 20, 24} {
+		for _, quality := range []int{2, 5, 9} {
+			out := bytes.Buffer{}
+			w := NewWriterOptions(&out, WriterOptions{Quality: quality, LGBlock: lgblock})
+			if _, err := w.Write(opticks); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if lgblock != 0 && quality >= minQualityForBlockSplit && w.params.lgblock != lgblock {
+				t.Errorf("LGBlock %d, quality %d: encoder used lgblock %d", lgblock, quality, w.params.lgblock)
+			}
+			if err := checkCompressedData(out.Bytes(), opticks); err != nil {
+				t.Errorf("LGBlock %d, quality %d: %v", lgblock, quality, err)
+			}
+		}
+	}
+
+	for _, lgblock := range []int{-1, 15, 25} {
+		w := NewWriterOptions(ioutil.Discard, WriterOptions{LGBlock: lgblock})
+		if _, err := w.Write([]byte("hello")); err == nil {
+			t.Errorf("LGBlock %d: Write succeeded, want error", lgblock)
+		}
+		if err := w.Close(); err == nil {
+			t.Errorf("LGBlock %d: Close succeeded, want error", lgblock)
+		}
+	}
+}
+
+func TestDisableLiteralContextModeling(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, quality := range []int{5, 9, 11} {
+		encoded, err := Encode(opticks, WriterOptions{Quality: quality, DisableLiteralContextModeling: true})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		r := NewReader(bytes.NewReader(encoded))
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d: Decode: %v", quality, err)
+		}
+		if !bytes.Equal(decoded, opticks) {
+			t.Errorf("quality %d: decoded output doesn't match", quality)
+		}
+		// Every literal block type of the last metablock should take the
+		// decoder's trivial context path.
+		for i := uint32(0); i < r.num_block_types[0]; i++ {
+			if r.trivial_literal_contexts[i>>5]&(1<<(i&31)) == 0 {
+				t.Errorf("quality %d: literal block type %d has nontrivial context map", quality, i)
+			}
+		}
+	}
+}
+
+func TestWriterDistanceParams(t *testing.T) {
+	// A table of 8-byte records favors distances that are multiples of 8.
+	rnd := rand.New(rand.NewSource(0))
+	var input []byte
+	for i := 0; i < 10000; i++ {
+		input = append(input, byte(i), byte(i>>8), byte(rnd.Intn(4)), 0, 'a', 'b', byte(rnd.Intn(2)), 0)
+	}
+
+	var sizes [3]int
+	for i, options := range []WriterOptions{{Quality: 6}, {Quality: 6, NPostfix: 3}, {Quality: 6, SearchDistanceParams: true}} {
+		encoded, err := Encode(input, options)
+		if err != nil {
+			t.Fatalf("Encode(%+v): %v", options, err)
+		}
+		if err := checkCompressedData(encoded, input); err != nil {
+			t.Errorf("%+v: %v", options, err)
+		}
+		sizes[i] = len(encoded)
+	}
+	plain, tuned, searched := sizes[0], sizes[1], sizes[2]
+	if tuned >= plain || searched >= plain {
+		t.Errorf("distance params had no effect: default %d bytes, NPostfix=3 %d bytes, search %d bytes", plain, tuned, searched)
+	}
+
+	for _, test := range []struct {
+		npostfix, ndirect int
+		search            bool
+	}{
+		{0, 0, false},
+		{3, 0, false},
+		{3, 24, false},
+		{1, 12, false},
+		{0, 0, true},
+		{2, 8, true},
+	} {
+		for _, quality := range []int{4, 6, 9, 10} {
+			options := WriterOptions{Quality: quality, NPostfix: test.npostfix, NDirect: test.ndirect, SearchDistanceParams: test.search}
+			encoded, err := Encode(input, options)
+			if err != nil {
+				t.Fatalf("Encode(%+v): %v", options, err)
+			}
+			if err := checkCompressedData(encoded, input); err != nil {
+				t.Errorf("%+v: %v", options, err)
+			}
+		}
+	}
+
+	for _, test := range [][2]int{{4, 0}, {-1, 0}, {0, 16}, {2, 6}, {3, 128}} {
+		// Reset rejects them, so that no stream is started.
+		var out bytes.Buffer
+		w := NewWriterOptions(&out, WriterOptions{Quality: 5, NPostfix: test[0], NDirect: test[1]})
+		if _, err := w.Write(input); err != errInvalidDistance {
+			t.Errorf("NPostfix %d, NDirect %d: Write returned %v, want %v", test[0], test[1], err, errInvalidDistance)
+		}
+		w.Reset(&out)
+		if err := w.Close(); err != errInvalidDistance || out.Len() != 0 {
+			t.Errorf("NPostfix %d, NDirect %d: Close after Reset returned %v with %d bytes of output", test[0], test[1], err, out.Len())
+		}
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	part1 := bytes.Repeat([]byte("hello world!"), 1000)
+	part2 := bytes.Repeat([]byte("goodbye world?"), 1000)
+	for _, quality := range []int{0, 1, 5, 11} {
+		out := bytes.Buffer{}
+		w := NewWriterOptions(&out, WriterOptions{Quality: quality})
+		if err := w.WriteMetadata([]byte("header")); err != nil {
+			t.Fatalf("quality %d: WriteMetadata: %v", quality, err)
+		}
+		if _, err := w.Write(part1); err != nil {
+			t.Fatalf("quality %d: Write: %v", quality, err)
+		}
+		if err := w.WriteMetadata([]byte("record 1")); err != nil {
+			t.Fatalf("quality %d: WriteMetadata: %v", quality, err)
+		}
+
+		// Everything written before the metadata block must be decodable.
+		r := NewReader(bytes.NewReader(out.Bytes()))
+		got := make([]byte, len(part1))
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, part1) {
+			t.Errorf("quality %d: reading data before metadata: %v", quality, err)
+		}
+
+		if err := w.WriteMetadata(nil); err != nil {
+			t.Fatalf("quality %d: WriteMetadata(nil): %v", quality, err)
+		}
+		if _, err := w.Write(part2); err != nil {
+			t.Fatalf("quality %d: Write: %v", quality, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("quality %d: Close: %v", quality, err)
+		}
+		if err := checkCompressedData(out.Bytes(), append(append([]byte{}, part1...), part2...)); err != nil {
+			t.Errorf("quality %d: %v", quality, err)
+		}
+	}
+
+	// The shortest payloads need a size field all the same.
+	for _, payload := range []string{"m", "mm"} {
+		for _, before := range []string{"", "data"} {
+			out := bytes.Buffer{}
+			w := NewWriter(&out)
+			w.Write([]byte(before))
+			if err := w.WriteMetadata([]byte(payload)); err != nil {
+				t.Fatalf("WriteMetadata(%q): %v", payload, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			r := NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{
+				Metadata: func(offset int64, p []byte) { got = append(got, string(p)) },
+			})
+			decoded, err := io.ReadAll(r)
+			if err != nil || string(decoded) != before || !reflect.DeepEqual(got, []string{payload}) {
+				t.Errorf("WriteMetadata(%q) after %q: decoded %q, metadata %q, error %v", payload, before, decoded, got, err)
+			}
+		}
+	}
+
+	w := NewWriter(ioutil.Discard)
+	if err := w.WriteMetadata(make([]byte, MaxMetadataSize+1)); err == nil {
+		t.Errorf("WriteMetadata accepted %d bytes", MaxMetadataSize+1)
+	}
+	if err := w.WriteMetadata(make([]byte, MaxMetadataSize)); err != nil {
+		t.Errorf("WriteMetadata(%d bytes): %v", MaxMetadataSize, err)
+	}
+}
+
+func TestReaderMetadata(t *testing.T) {
+	type record struct {
+		offset int64
+		data   string
+	}
+	chunk := bytes.Repeat([]byte("hello world!"), 10000)
+	want := []record{{0, "start"}, {int64(len(chunk)), "middle"}, {int64(2 * len(chunk)), string(bytes.Repeat([]byte("m"), 100000))}}
+
+	for _, quality := range []int{0, 5, 11} {
+		out := bytes.Buffer{}
+		w := NewWriterOptions(&out, WriterOptions{Quality: quality, LGWin: 16})
+		w.WriteMetadata([]byte(want[0].data))
+		w.Write(chunk)
+		w.WriteMetadata([]byte(want[1].data))
+		w.Flush() // adds an empty metadata block, which should not be reported
+		w.Write(chunk)
+		w.WriteMetadata([]byte(want[2].data))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		var got []record
+		r := NewReaderOptions(bytes.NewReader(out.Bytes()), ReaderOptions{
+			Metadata: func(offset int64, data []byte) {
+				got = append(got, record{offset, string(data)})
+			},
+		})
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d: ReadAll: %v", quality, err)
+		}
+		if len(decoded) != 2*len(chunk) {
+			t.Errorf("quality %d: decoded %d bytes, want %d", quality, len(decoded), 2*len(chunk))
+		}
+		if len(got) != len(want) {
+			t.Fatalf("quality %d: got %d metadata blocks, want %d", quality, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("quality %d: metadata block %d at offset %d (%d bytes), want offset %d (%d bytes)", quality, i, got[i].offset, len(got[i].data), want[i].offset, len(want[i].data))
+			}
+		}
+	}
+}
+
+func TestCustomDictionary(t *testing.T) {
+	dict := []byte(`{"id":0,"name":"","email":"","roles":["reader","writer","admin"],"created_at":"2024-01-01T00:00:00Z","settings":{"theme":"dark","language":"en-US","notifications":true}}`)
+	payload := []byte(`{"id":12345,"name":"Jane Doe","email":"jane@example.com","roles":["reader","writer"],"created_at":"2024-03-15T08:30:00Z","settings":{"theme":"light","language":"en-US","notifications":false}}`)
+
+	for _, quality := range []int{0, 2, 4, 5, 9, 10, 11} {
+		plain, err := Encode(payload, WriterOptions{Quality: quality})
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		encoded, err := Encode(payload, WriterOptions{Quality: quality, Dictionary: dict})
+		if err != nil {
+			t.Fatalf("Encode with dictionary: %v", err)
+		}
+		if quality > 1 && len(encoded) >= len(plain)*3/4 {
+			t.Errorf("quality %d: %d bytes with dictionary, %d without", quality, len(encoded), len(plain))
+		}
+
+		r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: dict})
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d: decode with dictionary: %v", quality, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Errorf("quality %d: decoded %q, want %q", quality, decoded, payload)
+		}
+
+		r.Reset(bytes.NewReader(encoded))
+		if decoded, err = io.ReadAll(r); err != nil || !bytes.Equal(decoded, payload) {
+			t.Errorf("quality %d: decode with dictionary after Reset: %v", quality, err)
+		}
+	}
+
+	out := bytes.Buffer{}
+	w := NewWriterOptions(&out, WriterOptions{Quality: 11, Dictionary: dict})
+	w.Write(payload)
+	w.Close()
+	first := append([]byte{}, out.Bytes()...)
+	out.Reset()
+	w.Reset(&out)
+	w.Write(payload)
+	w.Close()
+	if !bytes.Equal(first, out.Bytes()) {
+		t.Error("Compressed data after Reset doesn't equal first time")
+	}
+
+	// A dictionary larger than the window is truncated to its tail.
+	big := make([]byte, 1<<17)
+	rand.New(rand.NewSource(0)).Read(big)
+	input := append(append([]byte{}, big[len(big)-1000:]...), big[len(big)-5000:]...)
+	encoded, err := Encode(input, WriterOptions{Quality: 5, LGWin: 16, Dictionary: big})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(encoded) > 1000 {
+		t.Errorf("got %d bytes; dictionary was not used", len(encoded))
+	}
+	decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: big}))
+	if err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("decoding with truncated dictionary: %v", err)
+	}
+}
+
 // Encode returns content encoded with Brotli.
+func TestSharedDictionary(t *testing.T) {
+	words := [][]byte{
+		[]byte("qzxv"), []byte("jkwpqz"), []byte("vvqqzzxx"), []byte("xyloquartzite"),
+		[]byte("zqjxwvkpfmbgcyl"), []byte("mnbvzxqwkj"), []byte("pqxzlmvwkjhgfdsaqr"), []byte("brxqpwtmzlkjv"),
+	}
+	var payload []byte
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		payload = append(payload, words[r.Intn(len(words))]...)
+		payload = append(payload, byte('0'+r.Intn(10)))
+	}
+
+	dict, err := NewSharedDictionary(nil, words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := dict.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSharedDictionary(serialized)
+	if err != nil {
+		t.Fatalf("ParseSharedDictionary: %v", err)
+	}
+	if again, _ := parsed.MarshalBinary(); !bytes.Equal(again, serialized) {
+		t.Error("MarshalBinary after ParseSharedDictionary differs")
+	}
+
+	for _, quality := range []int{4, 10} {
+		// Use only the first copy of each word, so LZ77 cannot help.
+		input := payload[:40]
+		plain, err := Encode(input, WriterOptions{Quality: quality, LGWin: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(input, WriterOptions{Quality: quality, LGWin: 10, SharedDictionary: dict})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(plain) {
+			t.Errorf("quality %d: %d bytes with custom words, %d without", quality, len(encoded), len(plain))
+		}
+		decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{SharedDictionary: parsed}))
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("quality %d: decode with custom words: %v", quality, err)
+		}
+	}
+
+	// Custom transforms: identity, omit last 1, and identity with a suffix.
+	custom := []byte{0x91, 0x00, 0x00, 1}
+	custom = append(custom, serialized[4:4+28]...)
+	custom = append(custom, dict.word_lists[0].data...)
+	custom = append(custom, 1, 4, 0, 0, 2, '!', '!', 3, 0, 0, 0, 0, 1, 0, 0, 0, 1)
+	custom = append(custom, 1, 0, 0)
+	transformed, err := ParseSharedDictionary(custom)
+	if err != nil {
+		t.Fatalf("ParseSharedDictionary: %v", err)
+	}
+	if serialized, _ := transformed.MarshalBinary(); !bytes.Equal(serialized, custom) {
+		t.Error("MarshalBinary with custom transforms differs")
+	}
+	input := []byte("xyloquartzitvvqqzzxx!!qzxv zqjxwvkpfmbgcyl")
+	for _, quality := range []int{4, 11} {
+		plain, err := Encode(input, WriterOptions{Quality: quality})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(input, WriterOptions{Quality: quality, SharedDictionary: transformed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(plain) {
+			t.Errorf("quality %d: %d bytes with custom transforms, %d without", quality, len(encoded), len(plain))
+		}
+		decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{SharedDictionary: transformed}))
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("quality %d: decode with custom transforms: %q, %v", quality, decoded, err)
+		}
+	}
+
+	// A context based dictionary with a prefix; the encoder only uses the prefix.
+	prefix := []byte("the prefix of a context based dictionary")
+	contextual := []byte{0x91, 0x00, byte(len(prefix))}
+	contextual = append(contextual, prefix...)
+	contextual = append(contextual, 0, 0, 2, 0, 0, 0, 0, 1)
+	for i := 0; i < 64; i++ {
+		contextual = append(contextual, byte(i&1))
+	}
+	shared, err := ParseSharedDictionary(contextual)
+	if err != nil {
+		t.Fatalf("ParseSharedDictionary: %v", err)
+	}
+	input = append([]byte("prefix of a context based dictionary: "), payload...)
+	encoded, err := Encode(input, WriterOptions{Quality: 9, SharedDictionary: shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{SharedDictionary: shared}))
+	if err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("decode with context based dictionary: %v", err)
+	}
+
+	if _, err := ParseSharedDictionary(contextual[:len(contextual)-1]); err == nil {
+		t.Error("ParseSharedDictionary accepted a truncated dictionary")
+	}
+	if _, err := Encode(input, WriterOptions{SharedDictionary: shared, Dictionary: prefix}); err == nil {
+		t.Error("Encode accepted both Dictionary and SharedDictionary prefixes")
+	}
+}
+
+func TestCutoffTransforms(t *testing.T) {
+	trans := *getTransforms()
+	computeCutoffTransforms(&trans)
+	var dict encoderDictionary
+	buildEncoderDictionary(&dict, getDictionary(), &trans)
+	if dict.cutoffTransformsCount != kCutoffTransformsCount || dict.cutoffTransforms != kCutoffTransforms {
+		t.Errorf("got %d cutoff transforms %#x, want %d %#x", dict.cutoffTransformsCount, dict.cutoffTransforms, kCutoffTransformsCount, kCutoffTransforms)
+	}
+}
+
+func TestReaderMemoryLimit(t *testing.T) {
+	input := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(input)
+	encoded, err := Encode(input, WriterOptions{Quality: 1, LGWin: 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var limitErr *MemoryLimitError
+	_, err = io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxWindow: 1 << 20}))
+	if !errors.As(err, &limitErr) || limitErr.Needed != 1<<22 || limitErr.Limit != 1<<20 {
+		t.Errorf("MaxWindow: got error %v, want MemoryLimitError", err)
+	}
+	if decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxWindow: 1 << 22})); err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("MaxWindow: decode within limit: %v", err)
+	}
+
+	decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxMemory: 1 << 20}))
+	if !errors.As(err, &limitErr) || limitErr.Limit != 1<<20 || limitErr.Needed <= 1<<20 {
+		t.Errorf("MaxMemory: got error %v, want MemoryLimitError", err)
+	}
+	if len(decoded) != 0 {
+		t.Errorf("MaxMemory: decoded %d bytes before failing", len(decoded))
+	}
+	if decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxMemory: 5 << 20})); err != nil || !bytes.Equal(decoded, input) {
+		t.Errorf("MaxMemory: decode within limit: %v", err)
+	}
+
+	// A small stream only needs a small ring buffer, whatever its window.
+	small, err := Encode(input[:1000], WriterOptions{Quality: 5, LGWin: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(small), ReaderOptions{MaxMemory: 64 << 10})); err != nil || !bytes.Equal(decoded, input[:1000]) {
+		t.Errorf("MaxMemory: decode small stream: %v", err)
+	}
+
+	// A prefix dictionary and metadata kept for the Metadata callback count
+	// as well.
+	dictStream, err := Encode(input[:1000], WriterOptions{Quality: 5, LGWin: 22, Dictionary: input})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(NewReaderOptions(bytes.NewReader(dictStream), ReaderOptions{Dictionary: input, MaxMemory: 512 << 10}))
+	if !errors.As(err, &limitErr) || limitErr.Needed <= 1<<20 {
+		t.Errorf("MaxMemory with Dictionary: got error %v, want MemoryLimitError", err)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteMetadata(input)
+	w.Close()
+	_, err = io.ReadAll(NewReaderOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{Metadata: func(int64, []byte) {}, MaxMemory: 512 << 10}))
+	if !errors.As(err, &limitErr) || limitErr.Needed < 1<<20 {
+		t.Errorf("MaxMemory with Metadata: got error %v, want MemoryLimitError", err)
+	}
+	if _, err := io.ReadAll(NewReaderOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{MaxMemory: 512 << 10})); err != nil {
+		t.Errorf("MaxMemory without Metadata: %v", err)
+	}
+}
+
+func TestReaderOutputLimit(t *testing.T) {
+	input := make([]byte, 10<<20)
+	encoded, err := Encode(input, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxOutput: 1 << 20})
+	decoded, err := io.ReadAll(r)
+	if !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("MaxOutput: got error %v, want ErrOutputLimit", err)
+	}
+	if len(decoded) != 1<<20 || int64(len(decoded)) != r.OutputOffset() {
+		t.Errorf("MaxOutput: decoded %d bytes, OutputOffset %d", len(decoded), r.OutputOffset())
+	}
+
+	// Output decoded before the limit was hit is returned, wherever it falls.
+	text := make([]byte, 3<<20)
+	for i := range text {
+		text[i] = byte(i * 7 / 13)
+	}
+	encodedText, err := Encode(text, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int64{777, 1<<20 + 12345} {
+		r = NewReaderOptions(bytes.NewReader(encodedText), ReaderOptions{MaxOutput: limit})
+		decoded, err := io.ReadAll(r)
+		if !errors.Is(err, ErrOutputLimit) || int64(len(decoded)) != limit {
+			t.Errorf("MaxOutput %d: decoded %d bytes, error %v", limit, len(decoded), err)
+		}
+	}
+
+	r = NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxOutput: int64(len(input))})
+	if decoded, err := io.ReadAll(r); err != nil || len(decoded) != len(input) {
+		t.Errorf("MaxOutput: decode at limit: %v", err)
+	}
+
+	r = NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxRatio: 100})
+	if decoded, err = io.ReadAll(r); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("MaxRatio: got error %v, want ErrOutputLimit", err)
+	}
+	// The ratio is checked at least once per window of output.
+	if int64(len(decoded)) > 100*int64(len(encoded))+1<<22 {
+		t.Errorf("MaxRatio: decoded %d bytes from %d", len(decoded), len(encoded))
+	}
+
+	r.Reset(bytes.NewReader(encoded))
+	if r.OutputOffset() != 0 {
+		t.Errorf("OutputOffset after Reset: %d", r.OutputOffset())
+	}
+	// A stream that compresses evenly decodes at its overall ratio.
+	ratio := len(text)/len(encodedText) + 1
+	r = NewReaderOptions(bytes.NewReader(encodedText), ReaderOptions{MaxRatio: ratio})
+	if decoded, err := io.ReadAll(r); err != nil || len(decoded) != len(text) {
+		t.Errorf("MaxRatio: decode within limit: %v", err)
+	}
+
+	// The ratio is taken to the input decoded, not to how much of it the
+	// Reader happened to read ahead.
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err = Encode(opticks, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, src := range []io.Reader{bytes.NewReader(encoded), iotest.OneByteReader(bytes.NewReader(encoded))} {
+		decoded, err := io.ReadAll(NewReaderOptions(src, ReaderOptions{MaxRatio: 2}))
+		if !errors.Is(err, ErrOutputLimit) {
+			t.Errorf("MaxRatio 2: got error %v, want ErrOutputLimit", err)
+		}
+		sizes = append(sizes, len(decoded))
+	}
+	if d := sizes[0] - sizes[1]; d > 1000 || d < -1000 {
+		t.Errorf("MaxRatio 2: decoded %d bytes with large reads, %d bytes with 1-byte reads", sizes[0], sizes[1])
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	input := []byte(randomstring.HumanFriendlyString(1 << 16))
+	encoded, err := Encode(input, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := append([]byte{}, encoded...)
+	k := len(corrupt) / 2
+	rand.New(rand.NewSource(0)).Read(corrupt[k:])
+	_, err = io.ReadAll(NewReader(bytes.NewReader(corrupt)))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrFormat) || errors.Is(err, ErrAllocation) {
+		t.Fatalf("corrupt input: got error %v, want a format DecodeError", err)
+	}
+	if decodeErr.Code >= 0 || decodeErr.Offset < int64(k) || decodeErr.Offset > int64(len(corrupt)) {
+		t.Errorf("corrupt input: code %d at offset %d, corruption starts at %d", decodeErr.Code, decodeErr.Offset, k)
+	}
+
+	if _, err = io.ReadAll(NewReader(bytes.NewReader(encoded[:k]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated input: got error %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	_, err = io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxWindow: 1 << 10}))
+	var limitErr *MemoryLimitError
+	if !errors.Is(err, ErrAllocation) || !errors.As(err, &limitErr) {
+		t.Errorf("MaxWindow: got error %v, want an allocation DecodeError", err)
+	}
+
+	shared, err := NewSharedDictionary([]byte("prefix"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: []byte("prefix"), SharedDictionary: shared}))
+	if !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("conflicting dictionaries: got error %v, want ErrInvalidArguments", err)
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	input := []byte(randomstring.HumanFriendlyString(1 << 20))
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5, LGWin: 16}, {Quality: 9, LGWin: 10}} {
+		encoded, err := Encode(input, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		r := NewReader(bytes.NewReader(encoded))
+		n, err := r.WriteTo(&out)
+		if err != nil || n != int64(len(input)) || !bytes.Equal(out.Bytes(), input) {
+			t.Errorf("%+v: WriteTo wrote %d bytes, error %v", options, n, err)
+		}
+
+		// WriteTo picks up where Read left off.
+		r.Reset(bytes.NewReader(encoded))
+		head := make([]byte, 1000)
+		if _, err := io.ReadFull(r, head); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if _, err := r.WriteTo(&out); err != nil || !bytes.Equal(append(head, out.Bytes()...), input) {
+			t.Errorf("%+v: WriteTo after Read: %v", options, err)
+		}
+
+		r = NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{MaxOutput: 5000})
+		out.Reset()
+		if n, err := r.WriteTo(&out); !errors.Is(err, ErrOutputLimit) || n != 5000 || !bytes.Equal(out.Bytes(), input[:5000]) {
+			t.Errorf("%+v: WriteTo with MaxOutput wrote %d bytes, error %v", options, n, err)
+		}
+
+		if _, err := NewReader(bytes.NewReader(encoded[:len(encoded)/2])).WriteTo(io.Discard); err != io.ErrUnexpectedEOF {
+			t.Errorf("%+v: WriteTo of truncated stream: %v", options, err)
+		}
+
+		// Trailing data is an error for WriteTo as for Read, even when it
+		// comes in a later read than the end of the stream.
+		trailing := io.MultiReader(bytes.NewReader(encoded), bytes.NewReader([]byte{0}))
+		if _, err := NewReader(trailing).WriteTo(io.Discard); err != errExcessiveInput {
+			t.Errorf("%+v: WriteTo with trailing data: %v", options, err)
+		}
+	}
+}
+
+func TestReaderMultistream(t *testing.T) {
+	var concatenated, want []byte
+	var boundaries []StreamBoundary
+	for i, segment := range []string{"first segment\n", "", strings.Repeat("third segment\n", 1000)} {
+		encoded, err := Encode([]byte(segment), WriterOptions{Quality: 3 * i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		concatenated = append(concatenated, encoded...)
+		want = append(want, segment...)
+		boundaries = append(boundaries, StreamBoundary{int64(len(concatenated)), int64(len(want))})
+	}
+
+	r := NewReaderOptions(bytes.NewReader(concatenated), ReaderOptions{Multistream: true})
+	decoded, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(decoded, want) {
+		t.Errorf("Read: %v", err)
+	}
+	if !reflect.DeepEqual(r.StreamBoundaries(), boundaries) {
+		t.Errorf("Read: got boundaries %v, want %v", r.StreamBoundaries(), boundaries)
+	}
+
+	// The first stream ends in a Read that runs out of room for its output.
+	r.Reset(bytes.NewReader(concatenated))
+	decoded, err = io.ReadAll(iotest.OneByteReader(r))
+	if err != nil || !bytes.Equal(decoded, want) {
+		t.Errorf("Read with small buffers: %v", err)
+	}
+
+	r.Reset(iotest.OneByteReader(bytes.NewReader(concatenated)))
+	var out bytes.Buffer
+	if _, err := r.WriteTo(&out); err != nil || !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("WriteTo: %v", err)
+	}
+	if !reflect.DeepEqual(r.StreamBoundaries(), boundaries) {
+		t.Errorf("WriteTo: got boundaries %v, want %v", r.StreamBoundaries(), boundaries)
+	}
+
+	r = NewReader(struct{ io.Reader }{bytes.NewReader(concatenated)})
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Read without Multistream accepted concatenated streams")
+	}
+	if !reflect.DeepEqual(r.StreamBoundaries(), boundaries[:1]) {
+		t.Errorf("got boundaries %v, want %v", r.StreamBoundaries(), boundaries[:1])
+	}
+
+	// Metadata offsets are positions in the output of all the streams.
+	concatenated = nil
+	for _, segment := range []string{"first", "second"} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Write([]byte(segment))
+		w.WriteMetadata([]byte(segment))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		concatenated = append(concatenated, buf.Bytes()...)
+	}
+	var offsets []int64
+	r = NewReaderOptions(bytes.NewReader(concatenated), ReaderOptions{
+		Multistream: true,
+		Metadata:    func(offset int64, p []byte) { offsets = append(offsets, offset) },
+	})
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{5, 11}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("metadata offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestReaderExactInput(t *testing.T) {
+	input := []byte(strings.Repeat("exact input\n", 1000))
+	encoded, err := Encode(input, WriterOptions{Quality: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := []byte("trailing data")
+	data := append(append([]byte{}, encoded...), trailer...)
+
+	for _, test := range []struct {
+		name string
+		src  func() io.Reader
+	}{
+		{"bufio", func() io.Reader { return bufio.NewReader(bytes.NewReader(data)) }},
+		{"Seeker", func() io.Reader { return bytes.NewReader(data) }},
+		{"ByteReader", func() io.Reader {
+			src := bytes.NewReader(data)
+			return struct {
+				io.ByteReader
+				io.Reader
+			}{src, src}
+		}},
+	} {
+		src := test.src()
+		r := NewReader(src)
+		decoded, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("%s: decode: %v", test.name, err)
+			continue
+		}
+		if r.InputOffset() != int64(len(encoded)) {
+			t.Errorf("%s: InputOffset %d, want %d", test.name, r.InputOffset(), len(encoded))
+		}
+		rest := make([]byte, len(trailer)+1)
+		n := 0
+		for n < len(rest) {
+			c, err := src.(io.ByteReader).ReadByte()
+			if err != nil {
+				break
+			}
+			rest[n] = c
+			n++
+		}
+		if !bytes.Equal(rest[:n], trailer) {
+			t.Errorf("%s: left %q after the stream, want %q", test.name, rest[:n], trailer)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 1<<16)
+	rand.Read(random)
+
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 11, LGWin: 18})
+	w.Write(opticks)
+	w.Flush()
+	w.WriteMetadata([]byte("metadata"))
+	w.Write(random)
+	w.Close()
+	encoded := buf.Bytes()
+
+	metablocks, info, err := InspectWithOptions(bytes.NewReader(encoded), InspectOptions{Commands: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.WindowBits != 18 || info.LargeWindow {
+		t.Errorf("got window bits %d, large window %v", info.WindowBits, info.LargeWindow)
+	}
+	if info.CompressedSize != int64(len(encoded)) || info.UncompressedSize != int64(len(opticks)+len(random)) {
+		t.Errorf("got sizes %d, %d", info.CompressedSize, info.UncompressedSize)
+	}
+
+	// The stream header holds the window size.
+	var offset, size int64 = 4, 0
+	var compressed, metadata, uncompressed int
+	for i, m := range metablocks {
+		if m.Offset != offset {
+			t.Errorf("metablock %d at bit %d, want %d", i, m.Offset, offset)
+		}
+		offset += m.CompressedBits
+		size += int64(m.UncompressedSize)
+		if m.Last != (i == len(metablocks)-1) {
+			t.Errorf("metablock %d: Last is %v", i, m.Last)
+		}
+		switch {
+		case m.Metadata:
+			// Flush pads with empty metadata blocks.
+			if m.MetadataSize != 0 {
+				metadata++
+			}
+		case m.Uncompressed:
+			uncompressed++
+		case m.UncompressedSize > 0:
+			compressed++
+			if len(m.ContextModes) != m.NumBlockTypes[0] || m.NumTrees[1] != m.NumBlockTypes[1] || m.NumTrees[0] == 0 {
+				t.Errorf("metablock %d: inconsistent %+v", i, m)
+			}
+			var n int
+			for _, c := range m.Commands {
+				n += c.Insert + c.Copy
+				if c.Copy != 0 && !c.Dictionary && (c.Distance <= 0 || c.Distance > 1<<18) {
+					t.Errorf("metablock %d: bad command %+v", i, c)
+				}
+			}
+			if n < m.UncompressedSize/2 {
+				t.Errorf("metablock %d: commands cover %d of %d bytes", i, n, m.UncompressedSize)
+			}
+		}
+	}
+	if (offset+7)/8 != int64(len(encoded)) || size != info.UncompressedSize {
+		t.Errorf("metablocks span %d bits and %d bytes", offset, size)
+	}
+	if compressed == 0 || metadata != 1 || uncompressed == 0 {
+		t.Errorf("got %d compressed, %d metadata and %d uncompressed metablocks", compressed, metadata, uncompressed)
+	}
+
+	metablocks, _, err = Inspect(bytes.NewReader(encoded[:len(encoded)/2]))
+	if err != io.ErrUnexpectedEOF || len(metablocks) == 0 || metablocks[0].Commands != nil {
+		t.Errorf("truncated stream: got %d metablocks, error %v", len(metablocks), err)
+	}
+}
+
+func TestSeekable(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := NewSeekableWriter(&buf, WriterOptions{Quality: 5}, 100000)
+	w.Write(opticks[:1000])
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(opticks[1000:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(opticks); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+	encoded := buf.Bytes()
+
+	decoded, err := io.ReadAll(NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Multistream: true}))
+	if err != nil || !bytes.Equal(decoded, opticks) {
+		t.Errorf("Multistream Reader: %v", err)
+	}
+
+	r, err := NewSeekableReader(bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(opticks)) {
+		t.Errorf("Size: got %d, want %d", r.Size(), len(opticks))
+	}
+	if err := iotest.TestReader(r, opticks); err != nil {
+		t.Error(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		off := rnd.Intn(len(opticks))
+		p := make([]byte, rnd.Intn(300000))
+		n, err := r.ReadAt(p, int64(off))
+		want := opticks[off:]
+		if len(want) > len(p) {
+			want = want[:len(p)]
+		}
+		if !bytes.Equal(p[:n], want) || (n < len(p)) != (err == io.EOF) {
+			t.Fatalf("ReadAt(%d bytes, %d): got %d bytes, %v", len(p), off, n, err)
+		}
+	}
+
+	if _, err := NewSeekableReader(bytes.NewReader(encoded[:len(encoded)-1]), int64(len(encoded)-1)); err != ErrNotSeekable {
+		t.Errorf("truncated: got error %v, want ErrNotSeekable", err)
+	}
+	plain, _ := Encode(opticks, WriterOptions{Quality: 1})
+	if _, err := NewSeekableReader(bytes.NewReader(plain), int64(len(plain))); err != ErrNotSeekable {
+		t.Errorf("plain stream: got error %v, want ErrNotSeekable", err)
+	}
+
+	// Chunk sizes in the index must match the data, and do not decide how
+	// much memory is allocated.
+	for _, size := range []int64{1 << 40, 999, 1001} {
+		buf.Reset()
+		w = NewSeekableWriter(&buf, WriterOptions{Quality: 1}, 1000)
+		w.Write(opticks[:1000])
+		w.Flush()
+		w.chunks[0].uncompressed_size = size
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err = NewSeekableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadAt(make([]byte, 10), 0); err != ErrNotSeekable {
+			t.Errorf("chunk size %d in index: got error %v, want ErrNotSeekable", size, err)
+		}
+	}
+
+	buf.Reset()
+	NewSeekableWriter(&buf, WriterOptions{}, 1000).Close()
+	r, err = NewSeekableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || r.Size() != 0 {
+		t.Errorf("empty: %v", err)
+	}
+}
+
+/* Reads one byte at a time, with a read of nothing between each. */
+type stallingReader struct {
+	r     io.Reader
+	stall bool
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	r.stall = !r.stall
+	if r.stall || len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestReaderMarshalBinary(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := opticks[:200000]
+	for _, options := range []WriterOptions{{Quality: 1}, {Quality: 5, LGWin: 16}, {Quality: 11}, {Quality: 6, Dictionary: opticks[200000:300000]}} {
+		encoded, err := Encode(input, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roptions := ReaderOptions{Dictionary: options.Dictionary}
+
+		// Save the state after every read of a few bytes of input, and
+		// carry on with a Reader restored from it.
+		var decoded []byte
+		r := NewReaderOptions(iotest.OneByteReader(bytes.NewReader(encoded)), roptions)
+		buf := make([]byte, 1000)
+		for i := 0; ; i++ {
+			n, err := r.Read(buf)
+			decoded = append(decoded, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("quality %d: %v", options.Quality, err)
+			}
+			if i%61 != 0 {
+				continue
+			}
+			state, err := r.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := r.InputOffset()
+			r = NewReaderOptions(iotest.OneByteReader(bytes.NewReader(encoded[offset:])), roptions)
+			if err := r.UnmarshalBinary(state); err != nil {
+				t.Fatalf("quality %d: UnmarshalBinary after %d bytes: %v", options.Quality, offset, err)
+			}
+			if r.InputOffset() != offset {
+				t.Errorf("InputOffset %d after UnmarshalBinary, want %d", r.InputOffset(), offset)
+			}
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Errorf("quality %d: resumed decoding gave different output", options.Quality)
+		}
+	}
+
+	// Save and restore at every Read from a source that is not an
+	// io.ByteReader, so that the decoder reads ahead and may stop in the
+	// middle of its internal input buffer.
+	encoded, err := Encode(opticks, WriterOptions{Quality: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1000, 4096, 10000, 65536} {
+		var decoded []byte
+		r := NewReader(struct{ io.Reader }{bytes.NewReader(encoded)})
+		buf := make([]byte, size)
+		for {
+			n, err := r.Read(buf)
+			decoded = append(decoded, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reads of %d bytes: %v", size, err)
+			}
+			state, err := r.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := r.InputOffset()
+			r = NewReader(struct{ io.Reader }{bytes.NewReader(encoded[offset:])})
+			if err := r.UnmarshalBinary(state); err != nil {
+				t.Fatalf("reads of %d bytes: UnmarshalBinary after %d bytes: %v", size, offset, err)
+			}
+		}
+		if !bytes.Equal(decoded, opticks) {
+			t.Errorf("reads of %d bytes: resumed decoding gave different output", size)
+		}
+	}
+
+	// Restored Readers must save the same state as the Reader they were
+	// restored from, however often that is repeated.
+	encoded, err = Encode(input[:20000], WriterOptions{Quality: 11, LGWin: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &stallingReader{r: bytes.NewReader(encoded)}
+	decoded := []byte{}
+	r := NewReader(src)
+	buf := make([]byte, 1000)
+	for i := 0; ; i++ {
+		n, err := r.Read(buf)
+		decoded = append(decoded, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("chained restores: read %d: %v", i, err)
+		}
+		state, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = NewReader(src)
+		if err := r.UnmarshalBinary(state); err != nil {
+			t.Fatalf("chained restores: UnmarshalBinary %d: %v", i, err)
+		}
+		if again, _ := r.MarshalBinary(); !bytes.Equal(again, state) {
+			t.Fatalf("chained restores: MarshalBinary %d after UnmarshalBinary differs", i)
+		}
+	}
+	if !bytes.Equal(decoded, input[:20000]) {
+		t.Error("chained restores: resumed decoding gave different output")
+	}
+
+	r = NewReader(bytes.NewReader(nil))
+	state, _ := r.MarshalBinary()
+	for i := range state {
+		bad := append([]byte{}, state...)
+		bad[i] ^= 0x40
+		if err := r.UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary accepted state with byte %d changed", i)
+		}
+	}
+	if err := NewReaderOptions(nil, ReaderOptions{Dictionary: []byte("dictionary")}).UnmarshalBinary(state); err == nil {
+		t.Error("UnmarshalBinary accepted state saved without the dictionary")
+	}
+
+	// States with a valid checksum but positions that do not fit the ring
+	// buffer are rejected rather than left to panic in the next Read.
+	encoded, err = Encode(input, WriterOptions{Quality: 5, LGWin: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(bytes.NewReader(encoded))
+	if _, err := io.ReadFull(r, make([]byte, 150000)); err != nil {
+		t.Fatal(err)
+	}
+	if r.rb_roundtrips == 0 {
+		t.Fatal("ring buffer has not wrapped")
+	}
+	state, err = r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tamper := range map[string]func(r *Reader){
+		"rb_roundtrips":          func(r *Reader) { r.rb_roundtrips = 255 },
+		"huge rb_roundtrips":     func(r *Reader) { r.rb_roundtrips = 1 << 60 },
+		"partial_pos_out behind": func(r *Reader) { r.partial_pos_out -= uint(r.ringbuffer_size) },
+		"partial_pos_out ahead":  func(r *Reader) { r.partial_pos_out += uint(r.ringbuffer_size) },
+		"pos":                    func(r *Reader) { r.pos = r.ringbuffer_size + 1000 },
+		"ringbuffer_size":        func(r *Reader) { r.ringbuffer_size = 0 },
+		"window_bits":            func(r *Reader) { r.window_bits = 20 },
+	} {
+		tampered := NewReader(nil)
+		if err := tampered.UnmarshalBinary(state); err != nil {
+			t.Fatal(err)
+		}
+		tamper(tampered)
+		bad, err := tampered.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewReader(nil).UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary accepted state with %s changed", name)
+		}
+	}
+}
+
+func TestReaderSalvage(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := opticks[:100000]
+
+	// Flush after every chunk, so that the metablocks after it start on a
+	// byte boundary.
+	var buf bytes.Buffer
+	var flushes []int
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 5, LGWin: 16})
+	for i := 0; i < len(input); i += 10000 {
+		if _, err := w.Write(input[i : i+10000]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		flushes = append(flushes, buf.Len())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// A truncated stream gives a prefix of the data.
+	truncated := encoded[:flushes[3]+100]
+	r := NewReaderOptions(bytes.NewReader(truncated), ReaderOptions{Salvage: true})
+	decoded, err := ioutil.ReadAll(r)
+	var serr *SalvageError
+	if !errors.As(err, &serr) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream: got error %v, want *SalvageError for io.ErrUnexpectedEOF", err)
+	}
+	if len(decoded) < 40000 || !bytes.Equal(decoded, input[:len(decoded)]) {
+		t.Errorf("truncated stream: got %d bytes, want a prefix of the input of at least 40000", len(decoded))
+	}
+	if serr.DecompressedOffset != int64(len(decoded)) || serr.CompressedOffset != int64(len(truncated)) || serr.ResumeOffset != -1 {
+		t.Errorf("truncated stream: got %+v", serr)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != serr {
+		t.Errorf("Read after damage: got %v, want %v", err, serr)
+	}
+
+	// Without Salvage, the usual error.
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(truncated))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream without Salvage: got error %v", err)
+	}
+
+	// Damage in the middle of the stream is skipped over with Resync.
+	corrupt := append([]byte{}, encoded...)
+	for i := flushes[4] + 500; i < flushes[4]+600; i++ {
+		corrupt[i] ^= 0x55
+	}
+	// A source that the Reader peeks into resumes at the same offsets.
+	for _, tc := range []struct {
+		writeTo bool
+		src     io.Reader
+	}{
+		{false, bytes.NewReader(corrupt)},
+		{true, bytes.NewReader(corrupt)},
+		{false, bufio.NewReader(bytes.NewReader(corrupt))},
+		{true, bufio.NewReader(bytes.NewReader(corrupt))},
+	} {
+		writeTo := tc.writeTo
+		r := NewReaderOptions(tc.src, ReaderOptions{Salvage: true, Resync: true})
+		var out bytes.Buffer
+		if writeTo {
+			_, err = r.WriteTo(&out)
+		} else {
+			_, err = io.Copy(&out, struct{ io.Reader }{r})
+		}
+		if err != nil {
+			t.Fatalf("corrupt stream with Resync: %v", err)
+		}
+		decoded := out.Bytes()
+		damage := r.Damage()
+		if len(damage) == 0 {
+			t.Fatal("no damage reported")
+		}
+		d := damage[0]
+		if d.DecompressedOffset < 50000 || d.ResumeOffset != int64(flushes[5]) {
+			t.Errorf("got damage at %d (decompressed %d), resumed at %d; want resumption at %d",
+				d.CompressedOffset, d.DecompressedOffset, d.ResumeOffset, flushes[5])
+		}
+		if r.InputOffset() != int64(len(corrupt)) {
+			t.Errorf("InputOffset %d at the end, want %d", r.InputOffset(), len(corrupt))
+		}
+		if !bytes.Equal(decoded[:50000], input[:50000]) {
+			t.Error("data before the damage is wrong")
+		}
+
+		// The chunks after the damage come through, except that what
+		// refers back into the lost data decodes to zeros.
+		if len(decoded) != int(d.DecompressedOffset)+40000 {
+			t.Fatalf("got %d bytes, want %d", len(decoded), d.DecompressedOffset+40000)
+		}
+		tail := decoded[len(decoded)-40000:]
+		for i, c := range tail {
+			if c != 0 && c != input[60000+i] {
+				t.Fatalf("byte %d after resuming is %q, want %q or 0", i, c, input[60000+i])
+			}
+		}
+	}
+}
+
+func TestResyncCandidateLimits(t *testing.T) {
+	// A metablock found after the damage that decodes to far more than the
+	// trial allows is taken as plausible without decoding all of it.
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, WriterOptions{Quality: 5, LGWin: 20})
+	w.Write([]byte("before the damage"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	start := buf.Len()
+	w.Write(make([]byte, 16<<20))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()[start:]
+
+	r := NewReaderOptions(nil, ReaderOptions{Salvage: true, Resync: true})
+	r.window_bits = 20
+	if !resyncCandidate(r, data) {
+		t.Fatal("metablock after a flush rejected")
+	}
+	if size := decodedSize(r.resync_trial); size > resyncTrialOutput+1<<20 {
+		t.Errorf("trial decoded %d bytes", size)
+	}
+
+	// The trial keeps to the limits of the Reader, and leaves it to report
+	// them.
+	r = NewReaderOptions(nil, ReaderOptions{Salvage: true, Resync: true, MaxMemory: 64 << 10})
+	r.window_bits = 20
+	if !resyncCandidate(r, data) {
+		t.Fatal("metablock after a flush rejected with MaxMemory")
+	}
+	if r.resync_trial.ringbuffer != nil {
+		t.Errorf("trial allocated a ring buffer of %d bytes with MaxMemory", len(r.resync_trial.ringbuffer))
+	}
+	r = NewReaderOptions(nil, ReaderOptions{Salvage: true, Resync: true, MaxOutput: 1000})
+	r.window_bits = 20
+	if !resyncCandidate(r, data) {
+		t.Fatal("metablock after a flush rejected with MaxOutput")
+	}
+	if max := r.resync_trial.options.MaxOutput; max != 1000 {
+		t.Errorf("trial MaxOutput %d, want 1000", max)
+	}
+}
+
+func TestParallelWriter(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := opticks[400000:]
+	for _, tc := range []struct {
+		options  WriterOptions
+		parallel ParallelOptions
+		size     int
+	}{
+		{WriterOptions{Quality: 0}, ParallelOptions{ChunkSize: 50000}, 300000},
+		{WriterOptions{Quality: 1}, ParallelOptions{ChunkSize: 50000, History: true}, 300000},
+		{WriterOptions{Quality: 2, LGWin: 16}, ParallelOptions{ChunkSize: 50000}, 300000},
+		{WriterOptions{Quality: 5, LGWin: 16}, ParallelOptions{ChunkSize: 30000, History: true}, 300000},
+		{WriterOptions{Quality: 5, LGWin: 16}, ParallelOptions{ChunkSize: 100000, Concurrency: 1}, 300000},
+		{WriterOptions{Quality: 6, Mode: ModeAuto}, ParallelOptions{ChunkSize: 70000, History: true}, 300000},
+		{WriterOptions{Quality: 7, Dictionary: dict}, ParallelOptions{ChunkSize: 50000, History: true}, 300000},
+		{WriterOptions{Quality: 9, LargeWindow: true, LGWin: 25}, ParallelOptions{ChunkSize: 50000, History: true}, 200000},
+		{WriterOptions{Quality: 10}, ParallelOptions{ChunkSize: 30000, History: true}, 100000},
+		{WriterOptions{Quality: 11, LGWin: 15}, ParallelOptions{ChunkSize: 20000}, 60000},
+		{WriterOptions{Quality: 11}, ParallelOptions{ChunkSize: 20000, History: true}, 60000},
+		{WriterOptions{Quality: 6}, ParallelOptions{}, 0},
+	} {
+		input := opticks[:tc.size]
+		var buf bytes.Buffer
+		w := NewParallelWriter(&buf, tc.options, tc.parallel)
+		// Write in pieces that do not line up with the chunks.
+		for p := input; len(p) > 0; {
+			n := 12345
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+			if len(p) < len(input)/2 && len(p)+n >= len(input)/2 {
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("x")); err != errWriterClosed {
+			t.Errorf("Write after Close: got %v, want %v", err, errWriterClosed)
+		}
+
+		r := NewReaderOptions(bytes.NewReader(buf.Bytes()), ReaderOptions{Dictionary: tc.options.Dictionary, LargeWindow: tc.options.LargeWindow})
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("quality %d, %+v: %v", tc.options.Quality, tc.parallel, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("quality %d, %+v: decoded output does not match input", tc.options.Quality, tc.parallel)
+		}
+
+		if tc.parallel.History && tc.options.Quality > 1 {
+			serial, err := Encode(input, tc.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() > len(serial)*21/20 {
+				t.Errorf("quality %d with History: %d bytes, more than 5%% over %d from Writer", tc.options.Quality, buf.Len(), len(serial))
+			}
+		}
+	}
+}
+
+func TestWriterFullFlush(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []WriterOptions{
+		{Quality: 1},
+		{Quality: 4, Mode: ModeText},
+		{Quality: 5, Mode: ModeText, LGWin: 16},
+		{Quality: 9},
+		{Quality: 10, LGWin: 16},
+		{Quality: 11, Mode: ModeText},
+	} {
+		// Messages of varying length, each followed by a full flush.
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		var starts []int
+		var input []byte
+		for i := 0; len(input) < 100000; i++ {
+			msg := opticks[len(input) : len(input)+1000+i*397%9000]
+			if _, err := w.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.FullFlush(); err != nil {
+				t.Fatal(err)
+			}
+			input = append(input, msg...)
+			starts = append(starts, len(input))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+		points := w.RestartPoints()
+		if len(points) != len(starts) {
+			t.Fatalf("quality %d: got %d restart points, want %d", options.Quality, len(points), len(starts))
+		}
+
+		decoded, err := Decode(encoded)
+		if err != nil || !bytes.Equal(decoded, input) {
+			t.Fatalf("quality %d: decoding failed: %v", options.Quality, err)
+		}
+
+		// Restart points are byte-aligned metablock boundaries.
+		metablocks, _, err := Inspect(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := make(map[int64]bool)
+		for _, m := range metablocks {
+			at[m.Offset] = true
+		}
+		for _, p := range points {
+			if !at[p*8] {
+				t.Errorf("quality %d: no metablock starts at restart point %d", options.Quality, p)
+			}
+		}
+
+		// A decoder that starts at a restart point, knowing only the window
+		// size, decodes the rest of the data, whether it takes the window to
+		// be empty or full of unknown data.
+		_, info, _ := Inspect(bytes.NewReader(encoded))
+		for i, p := range points {
+			for _, history := range []int{historyKnown, historyUnknownZero} {
+				r := NewReader(bytes.NewReader(encoded[p:]))
+				decoderStateResync(r, uint32(info.WindowBits), false)
+				r.unknown_history = history
+				decoded, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatalf("quality %d: decoding from restart point %d: %v", options.Quality, i, err)
+				}
+				if !bytes.Equal(decoded, input[starts[i]:]) {
+					t.Fatalf("quality %d: decoding from restart point %d gave different data", options.Quality, i)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	prefix := []byte("prefix")
+	for _, tc := range []struct {
+		options WriterOptions
+		input   []byte
+	}{
+		{WriterOptions{Quality: 1}, opticks[:100000]},
+		{WriterOptions{Quality: 2}, opticks[:100000]},
+		{WriterOptions{Quality: 4}, opticks[:100000]},
+		{WriterOptions{Quality: 6}, opticks[:100000]},
+		{WriterOptions{Quality: 9}, opticks[:100000]},
+		{WriterOptions{Quality: 10}, opticks[:100000]},
+		{WriterOptions{Quality: 11, LGWin: 16}, opticks[:200000]},
+		{WriterOptions{Quality: 11, Dictionary: opticks[:50000]}, opticks[50000:60000]},
+		{WriterOptions{Quality: 11}, opticks[:17]},
+		{WriterOptions{Quality: 11}, nil},
+		{WriterOptions{Quality: 5}, random},
+		{WriterOptions{Quality: 11}, random},
+	} {
+		// The input ends where its slice does, so reading past it fails.
+		input := tc.input[:len(tc.input):len(tc.input)]
+		encoded, err := EncodeAll(prefix, input, tc.options)
+		if err != nil {
+			t.Fatalf("EncodeAll(quality %d, %d bytes): %v", tc.options.Quality, len(input), err)
+		}
+		if !bytes.Equal(encoded[:len(prefix)], prefix) {
+			t.Fatalf("EncodeAll(quality %d, %d bytes) did not keep dst", tc.options.Quality, len(input))
+		}
+		encoded = encoded[len(prefix):]
+		if len(encoded) > MaxEncodedLen(len(input)) {
+			t.Errorf("EncodeAll(quality %d, %d bytes) = %d bytes; MaxEncodedLen is %d", tc.options.Quality, len(input), len(encoded), MaxEncodedLen(len(input)))
+		}
+		if tc.options.Dictionary == nil {
+			want, err := Encode(input, tc.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(want) <= MaxEncodedLen(len(input)) && !bytes.Equal(encoded, want) {
+				t.Errorf("EncodeAll(quality %d, %d bytes) differs from Writer output", tc.options.Quality, len(input))
+			}
+		}
+
+		r := NewReaderOptions(bytes.NewReader(encoded), ReaderOptions{Dictionary: tc.options.Dictionary})
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("EncodeAll(quality %d, %d bytes) did not round trip", tc.options.Quality, len(input))
+		}
+		if tc.options.Dictionary == nil {
+			decoded, err = DecodeAll(prefix, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded[:len(prefix)], prefix) || !bytes.Equal(decoded[len(prefix):], input) {
+				t.Fatalf("DecodeAll(%d bytes) did not round trip", len(input))
+			}
+		}
+	}
+
+	// The stream EncodeAll falls back to when compression does not pay off.
+	large := bytes.Repeat(random, 180)
+	for _, n := range []int{0, 1, 70000, 2 << 20, len(large)} {
+		stored := makeUncompressedStream(nil, large[:n])
+		if len(stored) > MaxEncodedLen(n) {
+			t.Errorf("uncompressed stream of %d bytes = %d bytes; MaxEncodedLen is %d", n, len(stored), MaxEncodedLen(n))
+		}
+		decoded, err := DecodeAll(nil, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, large[:n]) {
+			t.Fatalf("uncompressed stream of %d bytes did not round trip", n)
+		}
+	}
+
+	if _, err := DecodeAll(nil, []byte{0x1b, 0xff}); err == nil {
+		t.Error("DecodeAll of a truncated stream succeeded")
+	}
+	for _, tc := range []struct{ n, want int }{
+		{-1, -1},
+		{0, 2},
+		{1, 7},
+		{1 << 14, 1<<14 + 10},
+		{math.MaxInt, -1},
+	} {
+		if got := MaxEncodedLen(tc.n); got != tc.want {
+			t.Errorf("MaxEncodedLen(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		options WriterOptions
+		size    int
+	}{
+		{WriterOptions{Quality: 0}, 300000},
+		{WriterOptions{Quality: 1, LGWin: 16}, 300000},
+		{WriterOptions{Quality: 2}, 100},
+		{WriterOptions{Quality: 5, LGWin: 16}, 300000},
+		{WriterOptions{Quality: 9, Dictionary: opticks[400000:]}, 200000},
+		{WriterOptions{Quality: 11}, 30000},
+	} {
+		input := opticks[:tc.size]
+		for _, newReader := range []func() io.Reader{
+			func() io.Reader { return bytes.NewReader(input[100:]) },
+			func() io.Reader { return iotest.HalfReader(bytes.NewReader(input[100:])) },
+			func() io.Reader {
+				return &io.LimitedReader{R: iotest.OneByteReader(strings.NewReader(string(opticks[100:]))), N: int64(len(input) - 100)}
+			},
+		} {
+			var buf bytes.Buffer
+			w := NewWriterOptions(&buf, tc.options)
+			if _, err := w.Write(input[:50]); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(input[50:100]); err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(w, newReader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(input)-100) {
+				t.Fatalf("quality %d: ReadFrom read %d bytes, want %d", tc.options.Quality, n, len(input)-100)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := NewReaderOptions(&buf, ReaderOptions{Dictionary: tc.options.Dictionary})
+			decoded, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, input) {
+				t.Fatalf("quality %d: decoded output does not match input", tc.options.Quality)
+			}
+		}
+	}
+
+	// Reading a file straight into the window compresses as well as writing
+	// it with the same size hint.
+	f, err := os.Open("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got, want bytes.Buffer
+	w := NewWriterLevel(&got, 5)
+	if _, err := w.ReadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w = NewWriterLevel(&want, 5)
+	w.SetSizeHint(int64(len(opticks)))
+	w.Write(opticks)
+	w.Close()
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("ReadFrom of a file gave %d bytes, Write gave %d", got.Len(), want.Len())
+	}
+
+	for _, blockSize := range []int{0, 1 << 16} {
+		var buf bytes.Buffer
+		w := NewWriterV2(&buf, 5)
+		w.BlockSize = blockSize
+		if _, err := w.Write(opticks[:100]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, iotest.HalfReader(bytes.NewReader(opticks[100:]))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(opticks[:100]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, append(opticks[:len(opticks):len(opticks)], opticks[:100]...)) {
+			t.Fatalf("V2 with BlockSize %d: decoded output does not match input", blockSize)
+		}
+	}
+}
+
+func TestWriterStats(t *testing.T) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := opticks[:300000]
+	for _, options := range []WriterOptions{
+		{Quality: 0},
+		{Quality: 2},
+		{Quality: 5, KeepMetablockStats: true},
+		{Quality: 6, LGWin: 16, KeepMetablockStats: true},
+		{Quality: 9, KeepMetablockStats: true},
+		{Quality: 11, LGWin: 18, KeepMetablockStats: true},
+	} {
+		var buf bytes.Buffer
+		w := NewWriterOptions(&buf, options)
+		w.Write(input[:100000])
+		w.Flush()
+		w.WriteMetadata([]byte("metadata"))
+		w.Write(input[100000:200000])
+		w.FullFlush()
+		w.Write(input[200000:])
+		w.Write(bytes.Repeat([]byte{0}, 10000))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := w.Stats()
+		if stats.BytesIn != int64(len(input))+10000 || stats.BytesOut != int64(buf.Len()) {
+			t.Errorf("quality %d: Stats reports %d bytes in and %d out, want %d and %d", options.Quality, stats.BytesIn, stats.BytesOut, len(input)+10000, buf.Len())
+		}
+		if stats.Duration <= 0 {
+			t.Errorf("quality %d: Stats reports no time spent", options.Quality)
+		}
+		if !options.KeepMetablockStats {
+			if stats.NumMetablocks == 0 || stats.Metablocks != nil {
+				t.Errorf("quality %d: Stats reports %d metablocks, and %d described", options.Quality, stats.NumMetablocks, len(stats.Metablocks))
+			}
+			continue
+		}
+
+		// Each metablock is described as Inspect finds it.
+		infos, _, err := Inspect(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NumMetablocks != len(infos) || len(stats.Metablocks) != len(infos) {
+			t.Fatalf("quality %d: Stats reports %d metablocks, and %d described; Inspect finds %d", options.Quality, stats.NumMetablocks, len(stats.Metablocks), len(infos))
+		}
+		var compressed, literals int
+		for i, m := range stats.Metablocks {
+			info := infos[i]
+			// The padding at the end of the stream is not in the last
+			// metablock for Inspect.
+			padding := m.CompressedBits - info.CompressedBits
+			if !m.Last && padding != 0 || padding < 0 || padding > 7 ||
+				m.UncompressedSize != info.UncompressedSize || m.MetadataSize != info.MetadataSize ||
+				m.Last != info.Last || m.Uncompressed != info.Uncompressed || m.Metadata != info.Metadata {
+				t.Errorf("quality %d: metablock %d: Stats reports %+v; Inspect finds %+v", options.Quality, i, m, info)
+			}
+			if m.Uncompressed || m.Metadata || m.UncompressedSize == 0 {
+				continue
+			}
+			compressed++
+			literals += m.Literals
+			if m.NumBlockTypes != info.NumBlockTypes || m.NumHistograms != info.NumTrees || m.Commands == 0 {
+				t.Errorf("quality %d: metablock %d: Stats reports %+v; Inspect finds %+v", options.Quality, i, m, info)
+			}
+			if m.ContextMode != info.ContextModes[0] {
+				t.Errorf("quality %d: metablock %d: context mode %v, Inspect finds %v", options.Quality, i, m.ContextMode, info.ContextModes[0])
+			}
+		}
+		if compressed < 3 || literals == 0 {
+			t.Errorf("quality %d: %d compressed metablocks with %d literals", options.Quality, compressed, literals)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := NewWriterV2(&buf, 5)
+	w.Write(input[:100000])
+	if _, err := w.ReadFrom(iotest.HalfReader(bytes.NewReader(input[100000:]))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats := w.Stats()
+	if stats.BytesIn != int64(len(input)) || stats.BytesOut != int64(buf.Len()) || stats.Blocks != (len(input)+w.BlockSize-1)/w.BlockSize {
+		t.Errorf("V2 Stats = %+v, want %d bytes in, %d out", stats, len(input), buf.Len())
+	}
+}
+
 func Encode(content []byte, options WriterOptions) ([]byte, error) {
 	var buf bytes.Buffer
 	writer := NewWriterOptions(&buf, options)
@@ -623,6 +2495,74 @@ func BenchmarkDecodeLevels(b *testing.B) {
 	}
 }
 
+func BenchmarkDecodeLevelsRead(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for level := BestSpeed; level <= BestCompression; level++ {
+		buf := new(bytes.Buffer)
+		w := NewWriterLevel(buf, level)
+		w.Write(opticks)
+		w.Close()
+		compressed := buf.Bytes()
+		b.Run(fmt.Sprintf("%d", level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				// Hide WriteTo so that io.Copy goes through Read.
+				io.Copy(ioutil.Discard, struct{ io.Reader }{NewReader(bytes.NewReader(compressed))})
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeLevelsWriteTo(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for level := BestSpeed; level <= BestCompression; level++ {
+		buf := new(bytes.Buffer)
+		w := NewWriterLevel(buf, level)
+		w.Write(opticks)
+		w.Close()
+		compressed := buf.Bytes()
+		b.Run(fmt.Sprintf("%d", level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				NewReader(bytes.NewReader(compressed)).WriteTo(ioutil.Discard)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeLevelsNoLiteralContext(b *testing.B) {
+	opticks, err := ioutil.ReadFile("testdata/Isaac.Newton-Opticks.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for level := minQualityForContextModeling; level <= BestCompression; level++ {
+		buf := new(bytes.Buffer)
+		w := NewWriterOptions(buf, WriterOptions{Quality: level, DisableLiteralContextModeling: true})
+		w.Write(opticks)
+		w.Close()
+		compressed := buf.Bytes()
+		b.Run(fmt.Sprintf("%d", level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(opticks))/float64(len(compressed)), "ratio")
+			b.SetBytes(int64(len(opticks)))
+			for i := 0; i < b.N; i++ {
+				io.Copy(ioutil.Discard, NewReader(bytes.NewReader(compressed)))
+			}
+		})
+	}
+}
+
 func test(t *testing.T, filename string, m matchfinder.MatchFinder, blockSize int) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -0,0 +1,613 @@
+package brotli
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+)
+
+/* Decoder checkpoints
+
+   MarshalBinary writes the decoder state as:
+
+     4 bytes  readerStateMagic
+     1 byte   readerStateVersion
+     uint32   CRC-32 of ReaderOptions.Dictionary
+     uint32   CRC-32 of the serialized ReaderOptions.SharedDictionary
+     ...      the fields of Reader, in the order of Reader.transcode
+     uint32   CRC-32 of everything before it
+
+   Integers are varints, and slices that point into other slices are stored
+   as the index of the slice they point into and their offset in it. The
+   input the decoder has not consumed yet is not part of the state: decoding
+   resumes with the compressed data that follows InputOffset. */
+
+var readerStateMagic = [4]byte{'B', 'R', 'D', 'S'}
+
+const readerStateVersion = 3
+
+var (
+	errReaderState        = errors.New("brotli: invalid decoder state")
+	errReaderStateVersion = errors.New("brotli: unsupported decoder state version")
+	errReaderStateOptions = errors.New("brotli: decoder state was saved with different dictionaries")
+	errReaderFailed       = errors.New("brotli: cannot save the state of a failed Reader")
+)
+
+/* Visits the fields of the decoder state in a fixed order, so that the same
+   code serializes and restores them. */
+type readerStateCodec interface {
+	int(v *int)
+	int64(v *int64)
+	uint64(v *uint64)
+	bool(v *bool)
+	bytes(v *[]byte)
+	codes(v *[]huffmanCode)
+	byteRef(v *[]byte, base []byte)
+	codeRef(v *[]huffmanCode, bases ...[]huffmanCode)
+	invalid()
+}
+
+func (r *Reader) transcode(c readerStateCodec) {
+	var u uint64
+	u32 := func(v *uint32) { u = uint64(*v); c.uint64(&u); *v = uint32(u) }
+	u16 := func(v *uint16) { u = uint64(*v); c.uint64(&u); *v = uint16(u) }
+	uns := func(v *uint) { u = uint64(*v); c.uint64(&u); *v = uint(u) }
+
+	c.int(&r.state)
+	c.int(&r.loop_counter)
+	c.uint64(&r.br.val_)
+	u32(&r.br.bit_pos_)
+	/* The input itself is reconnected by the next decoderDecompressStream,
+	   but with bytes in r.buffer, input_len tells whether they complete
+	   the pending read. */
+	uns(&r.br.input_len)
+	uns(&r.br.byte_pos)
+	for i := range r.buffer.u8 {
+		u = uint64(r.buffer.u8[i])
+		c.uint64(&u)
+		r.buffer.u8[i] = byte(u)
+	}
+	u32(&r.buffer_length)
+	c.int(&r.pos)
+	c.int(&r.max_backward_distance)
+	c.int(&r.max_distance)
+	c.int(&r.ringbuffer_size)
+	c.int(&r.ringbuffer_mask)
+	c.int(&r.dist_rb_idx)
+	for i := range r.dist_rb {
+		c.int(&r.dist_rb[i])
+	}
+	c.int(&r.error_code)
+	u32(&r.sub_loop_counter)
+	/* Without a ring buffer size, the ring buffer is only kept for reuse. */
+	if r.ringbuffer_size != 0 {
+		c.bytes(&r.ringbuffer)
+		c.byteRef(&r.ringbuffer_end, r.ringbuffer)
+	}
+
+	for _, g := range []*huffmanTreeGroup{&r.literal_hgroup, &r.insert_copy_hgroup, &r.distance_hgroup} {
+		c.codes(&g.codes)
+		u16(&g.alphabet_size)
+		u16(&g.max_symbol)
+		u16(&g.num_htrees)
+		var n int = len(g.htrees)
+		c.int(&n)
+		if n < 0 || n > int(g.num_htrees) {
+			c.invalid()
+			return
+		}
+		if n != len(g.htrees) {
+			g.htrees = make([][]huffmanCode, n)
+		}
+		for i := range g.htrees {
+			c.codeRef(&g.htrees[i], g.codes)
+		}
+	}
+	c.codes(&r.block_type_trees)
+	c.codeRef(&r.block_len_trees, r.block_type_trees)
+	c.codeRef(&r.htree_command, r.insert_copy_hgroup.codes)
+	c.codeRef(&r.literal_htree, r.literal_hgroup.codes)
+	c.codeRef(&r.next, r.literal_hgroup.codes, r.insert_copy_hgroup.codes, r.distance_hgroup.codes)
+	var lut []byte = r.context_lookup
+	c.byteRef(&lut, kContextLookup[:])
+	r.context_lookup = lut
+	c.bytes(&r.context_map)
+	c.byteRef(&r.context_map_slice, r.context_map)
+	c.bytes(&r.dist_context_map)
+	c.byteRef(&r.dist_context_map_slice, r.dist_context_map)
+	c.bytes(&r.context_modes)
+	c.bytes(&r.metadata)
+
+	c.int(&r.trivial_literal_context)
+	c.int(&r.distance_context)
+	c.int(&r.meta_block_remaining_len)
+	u32(&r.block_length_index)
+	for i := 0; i < 3; i++ {
+		u32(&r.block_length[i])
+		u32(&r.num_block_types[i])
+	}
+	for i := range r.block_type_rb {
+		u32(&r.block_type_rb[i])
+	}
+	u32(&r.distance_postfix_bits)
+	u32(&r.num_direct_distance_codes)
+	c.int(&r.distance_postfix_mask)
+	u32(&r.num_dist_htrees)
+	u = uint64(r.dist_htree_index)
+	c.uint64(&u)
+	r.dist_htree_index = byte(u)
+	u32(&r.repeat_code_len)
+	u32(&r.prev_code_len)
+	c.int(&r.copy_length)
+	c.int(&r.distance_code)
+	uns(&r.rb_roundtrips)
+	uns(&r.partial_pos_out)
+	u32(&r.symbol)
+	u32(&r.repeat)
+	u32(&r.space)
+	var table []huffmanCode = r.table[:]
+	c.codes(&table)
+	if len(table) != len(r.table) {
+		c.invalid()
+		return
+	}
+	copy(r.table[:], table)
+	for i := range r.symbols_lists_array {
+		u16(&r.symbols_lists_array[i])
+	}
+	for i := range r.next_symbol {
+		c.int(&r.next_symbol[i])
+	}
+	var lengths []byte = r.code_length_code_lengths[:]
+	c.bytes(&lengths)
+	if len(lengths) != len(r.code_length_code_lengths) {
+		c.invalid()
+		return
+	}
+	copy(r.code_length_code_lengths[:], lengths)
+	for i := range r.code_length_histo {
+		u16(&r.code_length_histo[i])
+	}
+	c.int(&r.htree_index)
+	u32(&r.context_index)
+	u32(&r.max_run_length_prefix)
+	u32(&r.code)
+	table = r.context_map_table[:]
+	c.codes(&table)
+	if len(table) != len(r.context_map_table) {
+		c.invalid()
+		return
+	}
+	copy(r.context_map_table[:], table)
+	c.int(&r.substate_metablock_header)
+	c.int(&r.substate_tree_group)
+	c.int(&r.substate_context_map)
+	c.int(&r.substate_uncompressed)
+	c.int(&r.substate_huffman)
+	c.int(&r.substate_decode_uint8)
+	c.int(&r.substate_read_block_length)
+	uns(&r.is_last_metablock)
+	uns(&r.is_uncompressed)
+	uns(&r.is_metadata)
+	uns(&r.should_wrap_ringbuffer)
+	uns(&r.canny_ringbuffer_allocation)
+	c.bool(&r.large_window)
+	uns(&r.size_nibbles)
+	u32(&r.window_bits)
+	c.int(&r.new_ringbuffer_size)
+	u32(&r.num_literal_htrees)
+	for i := range r.trivial_literal_contexts {
+		u32(&r.trivial_literal_contexts[i])
+	}
+	c.int(&r.custom_dict_size)
+	c.int(&r.unknown_history)
+	c.int64(&r.salvage_pos)
+	c.int64(&r.memory_needed)
+	c.int64(&r.memory_limit)
+	c.int64(&r.total_out)
+	c.int64(&r.stream_start)
+	c.bool(&r.stream_ended)
+	var n int = len(r.boundaries)
+	c.int(&n)
+	if n < 0 || n > 1<<20 {
+		c.invalid()
+		return
+	}
+	if n != len(r.boundaries) {
+		r.boundaries = make([]StreamBoundary, n)
+	}
+	for i := range r.boundaries {
+		c.int64(&r.boundaries[i].CompressedOffset)
+		c.int64(&r.boundaries[i].DecompressedOffset)
+	}
+}
+
+/* Returns the offset of |s| in |base|, or -1 if |s| is not a tail of it. */
+func byteOffset(base []byte, s []byte) int {
+	if s == nil || cap(s) == 0 || cap(s) > cap(base) {
+		return -1
+	}
+	var off int = cap(base) - cap(s)
+	if off > len(base) || &base[:cap(base)][off] != &s[:1][0] {
+		return -1
+	}
+	return off
+}
+
+func codeOffset(base []huffmanCode, s []huffmanCode) int {
+	if s == nil || cap(s) == 0 || cap(s) > cap(base) {
+		return -1
+	}
+	var off int = cap(base) - cap(s)
+	if off > len(base) || &base[:cap(base)][off] != &s[:1][0] {
+		return -1
+	}
+	return off
+}
+
+type readerStateEncoder struct {
+	buf []byte
+}
+
+func (e *readerStateEncoder) int(v *int)       { e.buf = binary.AppendVarint(e.buf, int64(*v)) }
+func (e *readerStateEncoder) int64(v *int64)   { e.buf = binary.AppendVarint(e.buf, *v) }
+func (e *readerStateEncoder) uint64(v *uint64) { e.buf = binary.AppendUvarint(e.buf, *v) }
+
+func (e *readerStateEncoder) bool(v *bool) {
+	if *v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *readerStateEncoder) invalid() {}
+
+func (e *readerStateEncoder) bytes(v *[]byte) {
+	if *v == nil {
+		e.buf = binary.AppendVarint(e.buf, -1)
+		return
+	}
+	e.buf = binary.AppendVarint(e.buf, int64(len(*v)))
+	e.buf = append(e.buf, *v...)
+}
+
+func (e *readerStateEncoder) codes(v *[]huffmanCode) {
+	if *v == nil {
+		e.buf = binary.AppendVarint(e.buf, -1)
+		return
+	}
+	e.buf = binary.AppendVarint(e.buf, int64(len(*v)))
+	for _, code := range *v {
+		e.buf = append(e.buf, code.bits, byte(code.value), byte(code.value>>8))
+	}
+}
+
+func (e *readerStateEncoder) byteRef(v *[]byte, base []byte) {
+	e.buf = binary.AppendVarint(e.buf, int64(byteOffset(base, *v)))
+}
+
+func (e *readerStateEncoder) codeRef(v *[]huffmanCode, bases ...[]huffmanCode) {
+	for i, base := range bases {
+		if off := codeOffset(base, *v); off >= 0 {
+			e.buf = binary.AppendUvarint(e.buf, uint64(i))
+			e.buf = binary.AppendVarint(e.buf, int64(off))
+			return
+		}
+	}
+	e.buf = binary.AppendUvarint(e.buf, 0)
+	e.buf = binary.AppendVarint(e.buf, -1)
+}
+
+/* Decodes the state, checking each value as far as it can be checked on its
+   own; ok is cleared at the first bad one and everything after is zero. */
+type readerStateDecoder struct {
+	buf []byte
+	ok  bool
+}
+
+func (d *readerStateDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 || !d.ok {
+		d.ok = false
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *readerStateDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 || !d.ok {
+		d.ok = false
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+/* Reads a slice length, which is -1 for nil; |size| is the encoded size of
+   an element. */
+func (d *readerStateDecoder) length(size int) int {
+	n := d.varint()
+	if n < -1 || n > int64(len(d.buf)/size) {
+		d.ok = false
+		return -1
+	}
+	return int(n)
+}
+
+func (d *readerStateDecoder) int(v *int) {
+	x := d.varint()
+	if int64(int(x)) != x {
+		d.ok = false
+	}
+	*v = int(x)
+}
+
+func (d *readerStateDecoder) int64(v *int64) { *v = d.varint() }
+
+func (d *readerStateDecoder) uint64(v *uint64) { *v = d.uvarint() }
+func (d *readerStateDecoder) invalid()         { d.ok = false }
+
+func (d *readerStateDecoder) bool(v *bool) {
+	x := d.uvarint()
+	if x > 1 {
+		d.ok = false
+	}
+	*v = x == 1
+}
+
+func (d *readerStateDecoder) bytes(v *[]byte) {
+	n := d.length(1)
+	if n < 0 {
+		*v = nil
+		return
+	}
+	if *v == nil || len(*v) != n {
+		*v = make([]byte, n)
+	}
+	copy(*v, d.buf[:n])
+	d.buf = d.buf[n:]
+}
+
+func (d *readerStateDecoder) codes(v *[]huffmanCode) {
+	n := d.length(3)
+	if n < 0 {
+		*v = nil
+		return
+	}
+	if *v == nil || len(*v) != n {
+		*v = make([]huffmanCode, n)
+	}
+	for i := range *v {
+		(*v)[i] = huffmanCode{bits: d.buf[0], value: uint16(d.buf[1]) | uint16(d.buf[2])<<8}
+		d.buf = d.buf[3:]
+	}
+}
+
+func (d *readerStateDecoder) byteRef(v *[]byte, base []byte) {
+	off := d.varint()
+	if off < -1 || off > int64(len(base)) {
+		d.ok = false
+		off = -1
+	}
+	if off < 0 {
+		*v = nil
+	} else {
+		*v = base[off:]
+	}
+}
+
+func (d *readerStateDecoder) codeRef(v *[]huffmanCode, bases ...[]huffmanCode) {
+	i := d.uvarint()
+	off := d.varint()
+	if i >= uint64(len(bases)) || off < -1 || off > int64(len(bases[i])) {
+		d.ok = false
+		off = -1
+	}
+	if off < 0 {
+		*v = nil
+	} else {
+		*v = bases[i][off:]
+	}
+}
+
+/* Fingerprints the dictionaries the state depends on. */
+func (r *Reader) dictionaryChecksums() (uint32, uint32, error) {
+	var shared uint32
+	if d := r.options.SharedDictionary; d != nil {
+		data, err := d.MarshalBinary()
+		if err != nil {
+			return 0, 0, err
+		}
+		shared = crc32.ChecksumIEEE(data)
+	}
+	return crc32.ChecksumIEEE(r.options.Dictionary), shared, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. It saves the state of
+// the decoder, including its window, so that decoding can be resumed later,
+// possibly in another process, by UnmarshalBinary.
+//
+// The state covers the compressed input up to InputOffset. Input that the
+// Reader has read from its source but not decoded yet is not saved; it must
+// be supplied again, with the rest of the stream, to the resumed Reader.
+// The state of a Reader that has failed, or that has run into damage with
+// ReaderOptions.Salvage set, cannot be saved; nor can what Damage reports.
+func (r *Reader) MarshalBinary() ([]byte, error) {
+	if r.error_code < 0 || r.salvaging || r.salvage_err != nil {
+		return nil, errReaderFailed
+	}
+	dict, shared, err := r.dictionaryChecksums()
+	if err != nil {
+		return nil, err
+	}
+
+	var e readerStateEncoder
+	e.buf = append(e.buf, readerStateMagic[:]...)
+	e.buf = append(e.buf, readerStateVersion)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, dict)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, shared)
+	var total_in int64 = r.InputOffset()
+	e.int64(&total_in)
+	r.transcode(&e)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, crc32.ChecksumIEEE(e.buf))
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It restores a
+// decoder state saved by MarshalBinary. The Reader keeps its source and
+// options, which must include the same dictionaries as those of the Reader
+// the state was saved from; its source must continue with the compressed
+// data that followed InputOffset when the state was saved.
+func (r *Reader) UnmarshalBinary(data []byte) error {
+	const header = len(readerStateMagic) + 1 + 8
+	if len(data) < header+4 || [4]byte(data[:4]) != readerStateMagic {
+		return errReaderState
+	}
+	if data[4] != readerStateVersion {
+		return errReaderStateVersion
+	}
+	var body []byte = data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return errReaderState
+	}
+	dict, shared, err := r.dictionaryChecksums()
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(data[5:]) != dict || binary.LittleEndian.Uint32(data[9:]) != shared {
+		return errReaderStateOptions
+	}
+
+	/* Decode into a fresh Reader, so that r is left alone on failure. */
+	var s Reader = Reader{options: r.options}
+	decoderStateInit(&s)
+	d := readerStateDecoder{buf: body[header:], ok: true}
+	var total_in int64
+	d.int64(&total_in)
+	s.transcode(&d)
+	if !d.ok || len(d.buf) != 0 || !s.validState() {
+		return errReaderState
+	}
+
+	s.src = r.src
+	s.buf = r.buf
+	s.exact = r.exact
+	s.total_in = total_in
+	*r = s
+	/* The copy still points into the array of s. */
+	r.symbol_lists.storage = r.symbols_lists_array[:]
+	if r.buf == nil {
+		r.buf = make([]byte, readBufSize)
+	}
+	return nil
+}
+
+/* Checks the invariants the decoder relies on to index its buffers. */
+func (s *Reader) validState() bool {
+	if s.state < stateUninited || s.state > stateDone || s.error_code < 0 {
+		return false
+	}
+	if s.buffer_length > uint32(len(s.buffer.u8)) || s.br.bit_pos_ > 64 || s.br.byte_pos > s.br.input_len {
+		return false
+	}
+	if s.window_bits > largeMaxWbits || s.ringbuffer_size < 0 || s.ringbuffer_size&(s.ringbuffer_size-1) != 0 ||
+		s.ringbuffer_size > 1<<s.window_bits {
+		return false
+	}
+	if s.ringbuffer_size != 0 {
+		var slack int = int(kRingBufferWriteAheadSlack)
+		if s.options.SharedDictionary != nil {
+			slack += sharedDictionaryWriteAheadSlack
+		}
+		if len(s.ringbuffer) < s.ringbuffer_size+slack || s.ringbuffer_mask != s.ringbuffer_size-1 ||
+			s.pos < 0 || s.pos > s.ringbuffer_size+slack || len(s.ringbuffer_end) != len(s.ringbuffer)-s.ringbuffer_size {
+			return false
+		}
+		/* The ring buffer only wraps once it is as large as the window. */
+		if (s.rb_roundtrips != 0 && s.ringbuffer_size != 1<<s.window_bits) ||
+			s.rb_roundtrips > uint(math.MaxInt64)/uint(s.ringbuffer_size) {
+			return false
+		}
+	} else if s.pos != 0 || s.rb_roundtrips != 0 || s.ringbuffer != nil {
+		return false
+	}
+	if s.new_ringbuffer_size < 0 || s.new_ringbuffer_size&(s.new_ringbuffer_size-1) != 0 ||
+		s.new_ringbuffer_size > 1<<s.window_bits {
+		return false
+	}
+	/* Output is written up to the end of the ring buffer before it wraps, so
+	   what is left to write lies between its start and pos. */
+	var wrapped uint = s.rb_roundtrips * uint(s.ringbuffer_size)
+	if s.partial_pos_out < wrapped || s.partial_pos_out > wrapped+uint(brotli_min_int(s.pos, s.ringbuffer_size)) {
+		return false
+	}
+	if s.block_type_trees != nil && len(s.block_type_trees) != 3*(huffmanMaxSize258+huffmanMaxSize26) {
+		return false
+	}
+	for _, g := range []*huffmanTreeGroup{&s.literal_hgroup, &s.insert_copy_hgroup, &s.distance_hgroup} {
+		if len(g.htrees) != 0 && len(g.htrees) != int(g.num_htrees) {
+			return false
+		}
+		if len(g.htrees) != 0 && (g.alphabet_size == 0 || int(g.max_symbol) > int(g.alphabet_size) ||
+			len(g.codes) != int(g.num_htrees)*int(kMaxHuffmanTableSize[(g.alphabet_size+31)>>5])) {
+			return false
+		}
+	}
+	for i := 0; i < 3; i++ {
+		/* Block types are set up by the first metablock header. */
+		if s.num_block_types[i] == 0 && s.state <= stateMetablockBegin {
+			continue
+		}
+		if s.num_block_types[i] < 1 || s.num_block_types[i] > 256 || s.block_type_rb[2*i+1] >= s.num_block_types[i] {
+			return false
+		}
+	}
+	if len(s.distance_hgroup.htrees) != 0 && uint32(s.dist_htree_index) >= s.num_dist_htrees {
+		return false
+	}
+	switch s.state {
+	case stateHuffmanCode0, stateHuffmanCode1, stateHuffmanCode2, stateHuffmanCode3:
+		if s.loop_counter < 0 || s.loop_counter > 3 || (s.loop_counter == 3 && s.state != stateHuffmanCode0) {
+			return false
+		}
+	case stateTreeGroup:
+		if s.loop_counter < 0 || s.loop_counter > 2 {
+			return false
+		}
+	}
+	if s.context_map != nil && len(s.context_map) != int(s.num_block_types[0])<<literalContextBits {
+		return false
+	}
+	if s.dist_context_map != nil && len(s.dist_context_map) != int(s.num_block_types[2])<<distanceContextBits {
+		return false
+	}
+	if s.context_modes != nil && len(s.context_modes) != int(s.num_block_types[0]) {
+		return false
+	}
+	for _, m := range s.context_map {
+		if uint32(m) >= s.num_literal_htrees && len(s.literal_hgroup.htrees) != 0 {
+			return false
+		}
+	}
+	for _, m := range s.dist_context_map {
+		if uint32(m) >= s.num_dist_htrees && len(s.distance_hgroup.htrees) != 0 {
+			return false
+		}
+	}
+	if s.context_lookup != nil && len(s.context_lookup) < 512 {
+		return false
+	}
+	if s.distance_postfix_bits > 3 || s.num_direct_distance_codes > numDistanceShortCodes+(15<<3) ||
+		s.distance_postfix_mask != int(bitMask(s.distance_postfix_bits)) {
+		return false
+	}
+	if s.custom_dict_size < 0 || s.htree_index < 0 || s.copy_length < 0 ||
+		s.unknown_history < historyKnown || s.unknown_history > historyUnknownAny || s.salvage_pos < 0 {
+		return false
+	}
+	return true
+}
@@ -39,6 +39,7 @@ const (
 	decoderErrorFormatPadding1              = -14
 	decoderErrorFormatPadding2              = -15
 	decoderErrorFormatDistance              = -16
+	decoderErrorFormatLargeWindow           = -17
 	decoderErrorDictionaryNotSet            = -19
 	decoderErrorInvalidArguments            = -20
 	decoderErrorAllocContextModes           = -21
@@ -46,6 +47,8 @@ const (
 	decoderErrorAllocContextMap             = -25
 	decoderErrorAllocRingBuffer1            = -26
 	decoderErrorAllocRingBuffer2            = -27
+	decoderErrorAllocMemoryLimit            = -28
+	decoderErrorOutputLimit                 = -29
 	decoderErrorAllocBlockTypeTrees         = -30
 	decoderErrorUnreachable                 = -31
 )
@@ -113,7 +116,8 @@ func decodeWindowBits(s *Reader, br *bitReader) int {
 			s.large_window = true
 			return decoderSuccess
 		} else {
-			return decoderErrorFormatWindowBits
+			/* Large window streams must be explicitly allowed. */
+			return decoderErrorFormatLargeWindow
 		}
 	}
 
@@ -1226,6 +1230,39 @@ func safeDecodeDistanceBlockSwitch(s *Reader) bool {
 	return decodeDistanceBlockSwitchInternal(1, s)
 }
 
+/* Returns the number of bytes decoded so far, whether or not they have been
+   written out of the ring buffer yet. */
+func decodedSize(s *Reader) int64 {
+	return int64(s.rb_roundtrips)*int64(s.ringbuffer_size) + int64(s.pos) - int64(s.custom_dict_size)
+}
+
+/* Checks ReaderOptions.MaxOutput and MaxRatio against the bytes decoded up
+   to ring buffer position |pos|. */
+func outputLimitExceeded(s *Reader, pos int) bool {
+	if s.options.MaxOutput <= 0 && s.options.MaxRatio <= 0 {
+		return false
+	}
+
+	var size int64 = int64(s.rb_roundtrips)*int64(s.ringbuffer_size) + int64(pos) - int64(s.custom_dict_size)
+	if s.options.MaxOutput > 0 && size > s.options.MaxOutput {
+		return true
+	}
+
+	return s.options.MaxRatio > 0 && size > int64(s.options.MaxRatio)*inputConsumed(s)
+}
+
+/* Returns the number of compressed bytes taken in by the bit reader, which
+   unlike the number read from the source does not depend on how much the
+   Reader reads at a time. Bytes moved to the internal buffer count as
+   taken in. */
+func inputConsumed(s *Reader) int64 {
+	var consumed int64 = s.total_in - int64(len(s.in))
+	if s.buffer_length == 0 {
+		consumed += int64(s.br.byte_pos)
+	}
+	return consumed
+}
+
 func unwrittenBytes(s *Reader, wrap bool) uint {
 	var pos uint
 	if wrap && s.pos > s.ringbuffer_size {
@@ -1309,6 +1346,9 @@ func ensureRingBuffer(s *Reader) bool {
 		return true
 	}
 	spaceNeeded := int(s.new_ringbuffer_size) + int(kRingBufferWriteAheadSlack)
+	if s.options.SharedDictionary != nil {
+		spaceNeeded += sharedDictionaryWriteAheadSlack
+	}
 	if len(s.ringbuffer) < spaceNeeded {
 		old_ringbuffer = s.ringbuffer
 		s.ringbuffer = make([]byte, spaceNeeded)
@@ -1383,6 +1423,70 @@ func copyUncompressedBlockToOutput(available_out *uint, next_out *[]byte, total_
 	}
 }
 
+/* Records |needed| and |limit| and returns false if |needed| bytes are over
+   a positive |limit|. */
+func checkMemoryLimit(s *Reader, needed int64, limit int64) bool {
+	if limit <= 0 || needed <= limit {
+		return true
+	}
+
+	s.memory_needed = needed
+	s.memory_limit = limit
+	return false
+}
+
+/* Returns the number of bytes used by the ring buffer and the block type
+   trees, context modes and context maps of the current metablock. Must be
+   called after calculateRingBufferSize. */
+func decoderMemoryNeeded(s *Reader) int64 {
+	var ringbuffer int = s.new_ringbuffer_size + int(kRingBufferWriteAheadSlack)
+	if s.options.SharedDictionary != nil {
+		ringbuffer += sharedDictionaryWriteAheadSlack
+	}
+	if len(s.ringbuffer) > ringbuffer {
+		ringbuffer = len(s.ringbuffer)
+	}
+
+	return int64(ringbuffer) + int64(len(s.block_type_trees))*huffmanCodeSize + int64(len(s.context_modes)) + int64(len(s.context_map)) + int64(len(s.dist_context_map))
+}
+
+/* Size of a huffmanCode in bytes. */
+const huffmanCodeSize = 4
+
+/* Returns the number of bytes decoderHuffmanTreeGroupInit allocates. */
+func huffmanTreeGroupSize(alphabet_size uint32, ntrees uint32) int64 {
+	var max_table_size int64 = int64(kMaxHuffmanTableSize[(alphabet_size+31)>>5])
+	return int64(ntrees) * (max_table_size*huffmanCodeSize + 24)
+}
+
+/* Returns the size of the ring buffer that decoderPrependCustomDictionary
+   allocates for |dict|. */
+func customDictionaryRingBufferSize(s *Reader, dict []byte) int {
+	var size int = 1024
+	for size < len(dict) && size < s.max_backward_distance {
+		size <<= 1
+	}
+	return size
+}
+
+/* Places the last window-size bytes of |dict| at the start of the ring buffer,
+   as if they had already been decoded and written out, so that backward
+   references can reach into them.
+
+   Window size MUST be decoded before this function is called. */
+func decoderPrependCustomDictionary(s *Reader, dict []byte) {
+	if len(dict) > s.max_backward_distance {
+		dict = dict[len(dict)-s.max_backward_distance:]
+	}
+
+	s.new_ringbuffer_size = customDictionaryRingBufferSize(s, dict)
+	ensureRingBuffer(s)
+	copy(s.ringbuffer, dict)
+	s.pos = len(dict)
+	s.partial_pos_out = uint(len(dict))
+	s.custom_dict_size = len(dict)
+}
+
 /* Calculates the smallest feasible ring buffer.
 
    If we know the data size is small, do not allocate more ring buffer
@@ -1637,6 +1741,12 @@ func processCommandsInternal(safe int, s *Reader) int {
 		warmupBitReader(br)
 	}
 
+	/* Long commands resume here after each ring buffer wrap. */
+	if outputLimitExceeded(s, pos) {
+		result = decoderErrorOutputLimit
+		goto saveStateAndReturn
+	}
+
 	/* Jump into state machine. */
 	if s.state == stateCommandBegin {
 		goto CommandBegin
@@ -1661,6 +1771,14 @@ CommandBegin:
 		goto saveStateAndReturn
 	}
 
+	if outputLimitExceeded(s, pos) {
+		result = decoderErrorOutputLimit
+		goto saveStateAndReturn
+	}
+
+	/* Everything before is complete commands. */
+	s.salvage_pos = int64(s.rb_roundtrips)*int64(s.ringbuffer_size) + int64(pos)
+
 	if s.block_length[1] == 0 {
 		if safe != 0 {
 			if !safeDecodeCommandBlockSwitch(s) {
@@ -1684,6 +1802,10 @@ CommandBegin:
 		readCommand(s, br, &i)
 	}
 
+	if s.inspector != nil {
+		s.inspector.command(i)
+	}
+
 	if i == 0 {
 		goto CommandPostDecodeLiterals
 	}
@@ -1854,6 +1976,10 @@ CommandPostDecodeLiterals:
 		}
 	}
 
+	if s.inspector != nil {
+		s.inspector.distance(s)
+	}
+
 	i = s.copy_length
 
 	/* Apply copy of LZ77 back-reference, or static dictionary reference if
@@ -1866,12 +1992,18 @@ CommandPostDecodeLiterals:
 			return decoderErrorFormatDistance
 		}
 
-		if i >= minDictionaryWordLength && i <= maxDictionaryWordLength {
+		if i >= minDictionaryWordLength && i <= maxSharedDictionaryWordLength {
 			var address int = s.distance_code - s.max_distance - 1
 			var words *dictionary = s.dictionary
 			var trans *transforms = s.transforms
-			var offset int = int(s.dictionary.offsets_by_length[i])
-			var shift uint32 = uint32(s.dictionary.size_bits_by_length[i])
+			if shared := s.options.SharedDictionary; shared != nil {
+				var p1 byte = s.ringbuffer[(pos-1)&s.ringbuffer_mask]
+				var p2 byte = s.ringbuffer[(pos-2)&s.ringbuffer_mask]
+				words, trans, address = shared.lookup(i, address, p1, p2, s.context_lookup)
+			}
+
+			var offset int = int(words.offsets_by_length[i])
+			var shift uint32 = uint32(words.size_bits_by_length[i])
 			var mask int = int(bitMask(shift))
 			var word_idx int = address & mask
 			var transform_idx int = address >> shift
@@ -1884,6 +2016,10 @@ CommandPostDecodeLiterals:
 				return decoderErrorDictionaryNotSet
 			}
 
+			if shift == 0 {
+				return decoderErrorFormatDictionary
+			}
+
 			if transform_idx < int(trans.num_transforms) {
 				word := words.data[offset:]
 				var len int = i
@@ -2167,13 +2303,25 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				break
 			}
 
+			if s.inspector != nil {
+				s.inspector.stream.LargeWindow = true
+			}
+
 			s.state = stateInitialize
 			fallthrough
 
 			/* Maximum distance, see section 9.1. of the spec. */
 		/* Fall through. */
 		case stateInitialize:
+			if !checkMemoryLimit(s, int64(1)<<s.window_bits, int64(s.options.MaxWindow)) {
+				result = decoderErrorAllocMemoryLimit
+				break
+			}
+
 			s.max_backward_distance = (1 << s.window_bits) - windowGap
+			if s.inspector != nil {
+				s.inspector.stream.WindowBits = int(s.window_bits)
+			}
 
 			/* Allocate memory for both block_type_trees and block_len_trees. */
 			s.block_type_trees = make([]huffmanCode, (3 * (huffmanMaxSize258 + huffmanMaxSize26)))
@@ -2185,12 +2333,42 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 
 			s.block_len_trees = s.block_type_trees[3*huffmanMaxSize258:]
 
+			/* History placed before the stream gets its ring buffer now, before
+			   any metablock header, so it is checked against MaxMemory here. */
+			var dict []byte = s.options.Dictionary
+			if shared := s.options.SharedDictionary; shared != nil && len(shared.prefix) != 0 {
+				if len(dict) != 0 && s.unknown_history == historyKnown {
+					result = decoderErrorInvalidArguments
+					break
+				}
+				dict = shared.prefix
+			}
+			if s.unknown_history != historyKnown {
+				s.new_ringbuffer_size = 1 << s.window_bits
+			} else if len(dict) != 0 {
+				s.new_ringbuffer_size = customDictionaryRingBufferSize(s, dict)
+			}
+			if s.new_ringbuffer_size != 0 && !checkMemoryLimit(s, decoderMemoryNeeded(s), s.options.MaxMemory) {
+				result = decoderErrorAllocMemoryLimit
+				break
+			}
+
+			if s.unknown_history != historyKnown {
+				decoderPrependUnknownHistory(s, s.unknown_history == historyUnknownZero)
+			} else if len(dict) != 0 {
+				decoderPrependCustomDictionary(s, dict)
+			}
+			s.salvage_pos = int64(s.pos)
+
 			s.state = stateMetablockBegin
 			fallthrough
 
 			/* Fall through. */
 		case stateMetablockBegin:
 			decoderStateMetablockBegin(s)
+			if s.inspector != nil {
+				s.inspector.metablockBegin(s, *available_in)
+			}
 
 			s.state = stateMetablockHeader
 			fallthrough
@@ -2210,7 +2388,17 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				}
 			}
 
+			if s.inspector != nil {
+				s.inspector.metablockHeader(s)
+			}
+
 			if s.is_metadata != 0 {
+				/* The payload is kept for the Metadata callback. */
+				if s.options.Metadata != nil && !checkMemoryLimit(s, decoderMemoryNeeded(s)+int64(brotli_max_int(cap(s.metadata), s.meta_block_remaining_len)), s.options.MaxMemory) {
+					result = decoderErrorAllocMemoryLimit
+					break
+				}
+				s.metadata = s.metadata[:0]
 				s.state = stateMetadata
 				break
 			}
@@ -2221,6 +2409,11 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 
 			calculateRingBufferSize(s)
+			if !checkMemoryLimit(s, decoderMemoryNeeded(s), s.options.MaxMemory) {
+				result = decoderErrorAllocMemoryLimit
+				break
+			}
+
 			if s.is_uncompressed != 0 {
 				s.state = stateUncompressed
 				break
@@ -2239,14 +2432,22 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			for ; s.meta_block_remaining_len > 0; s.meta_block_remaining_len-- {
 				var bits uint32
 
-				/* Read one byte and ignore it. */
+				/* Read one byte; keep it only if someone is listening. */
 				if !safeReadBits(br, 8, &bits) {
 					result = decoderNeedsMoreInput
 					break
 				}
+
+				if s.options.Metadata != nil {
+					s.metadata = append(s.metadata, byte(bits))
+				}
 			}
 
 			if result == decoderSuccess {
+				/* Empty metadata blocks are used as padding by encoders. */
+				if s.options.Metadata != nil && len(s.metadata) > 0 {
+					s.options.Metadata(s.stream_start+decodedSize(s), s.metadata)
+				}
 				s.state = stateMetablockDone
 			}
 
@@ -2368,6 +2569,14 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 					break
 				}
 
+				var needed int64 = decoderMemoryNeeded(s)
+				needed += huffmanTreeGroupSize(numLiteralSymbols, s.num_literal_htrees)
+				needed += huffmanTreeGroupSize(numCommandSymbols, s.num_block_types[1])
+				needed += huffmanTreeGroupSize(num_distance_codes, s.num_dist_htrees)
+				if !checkMemoryLimit(s, needed, s.options.MaxMemory) {
+					return saveErrorCode(s, decoderErrorAllocMemoryLimit)
+				}
+
 				if !decoderHuffmanTreeGroupInit(s, &s.literal_hgroup, numLiteralSymbols, numLiteralSymbols, s.num_literal_htrees) {
 					allocation_success = false
 				}
@@ -2408,6 +2617,9 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 			}
 			s.loop_counter++
 			if s.loop_counter >= 3 {
+				if s.inspector != nil {
+					s.inspector.metablockTrees(s)
+				}
 				prepareLiteralDecoding(s)
 				s.dist_context_map_slice = s.dist_context_map
 				s.htree_command = []huffmanCode(s.insert_copy_hgroup.htrees[0])
@@ -2426,6 +2638,14 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				result = safeProcessCommands(s)
 			}
 
+			if result == decoderErrorOutputLimit {
+				/* Hand out what was decoded before the limit was hit first. */
+				result = writeRingBuffer(s, available_out, next_out, nil, true)
+				if result == decoderSuccess {
+					result = decoderErrorOutputLimit
+				}
+			}
+
 		case stateCommandInnerWrite, stateCommandPostWrite1, stateCommandPostWrite2:
 			result = writeRingBuffer(s, available_out, next_out, nil, false)
 
@@ -2467,6 +2687,10 @@ func decoderDecompressStream(s *Reader, available_in *uint, next_in *[]byte, ava
 				break
 			}
 
+			if s.inspector != nil {
+				s.inspector.metablockEnd(s, *available_in)
+			}
+			s.salvage_pos = int64(s.rb_roundtrips)*int64(s.ringbuffer_size) + int64(s.pos)
 			decoderStateCleanupAfterMetablock(s)
 			if s.is_last_metablock == 0 {
 				s.state = stateMetablockBegin
@@ -2511,6 +2735,37 @@ func decoderHasMoreOutput(s *Reader) bool {
 	return s.ringbuffer != nil && unwrittenBytes(s, false) != 0
 }
 
+/* Returns up to |size| bytes of decoded output straight from the ring buffer,
+   or all that is available at once if |size| is 0. The slice is only valid
+   until the next call into the decoder. */
+func decoderTakeOutput(s *Reader, size uint) []byte {
+	var result []byte = nil
+	var available_out uint = size
+	if available_out == 0 {
+		available_out = 1 << 24
+	}
+	var requested_out uint = available_out
+	if s.ringbuffer == nil || int(s.error_code) < 0 {
+		return nil
+	}
+
+	wrapRingBuffer(s)
+	var status int = writeRingBuffer(s, &available_out, &result, nil, true)
+
+	/* Either WriteRingBuffer returns those "success" codes... */
+	if status == decoderSuccess || status == decoderNeedsMoreOutput {
+		return result[:requested_out-available_out]
+	}
+
+	/* ... or stream is broken. Normally this should be caught by
+	   decoderDecompressStream, this is just a safeguard. */
+	if status < 0 {
+		saveErrorCode(s, status)
+	}
+
+	return nil
+}
+
 func decoderGetErrorCode(s *Reader) int {
 	return int(s.error_code)
 }
@@ -2557,6 +2812,8 @@ func decoderErrorString(c int) string {
 		return "PADDING_2"
 	case decoderErrorFormatDistance:
 		return "DISTANCE"
+	case decoderErrorFormatLargeWindow:
+		return "LARGE_WINDOW"
 	case decoderErrorDictionaryNotSet:
 		return "DICTIONARY_NOT_SET"
 	case decoderErrorInvalidArguments:
@@ -2571,6 +2828,10 @@ func decoderErrorString(c int) string {
 		return "RING_BUFFER_1"
 	case decoderErrorAllocRingBuffer2:
 		return "RING_BUFFER_2"
+	case decoderErrorAllocMemoryLimit:
+		return "MEMORY_LIMIT"
+	case decoderErrorOutputLimit:
+		return "OUTPUT_LIMIT"
 	case decoderErrorAllocBlockTypeTrees:
 		return "BLOCK_TYPE_TREES"
 	case decoderErrorUnreachable:
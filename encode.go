@@ -3,6 +3,7 @@ package brotli
 import (
 	"io"
 	"math"
+	"time"
 )
 
 /* Copyright 2016 Google Inc. All Rights Reserved.
@@ -44,6 +45,7 @@ const (
 	modeGeneric = 0
 	modeText    = 1
 	modeFont    = 2
+	modeAuto    = 3
 )
 
 /** Default value for ::BROTLI_PARAM_QUALITY parameter. */
@@ -109,8 +111,33 @@ type Writer struct {
 	stream_state_             int
 	is_last_block_emitted_    bool
 	is_initialized_           bool
+
+	/* Set for the chunks of a ParallelWriter after the first, which continue
+	   a stream started elsewhere: the stream header is left out, and
+	   |history_|, the data before the chunk, is loaded in place of the
+	   dictionary. It is only hashed if |hash_history_| is set. */
+	continuation_ bool
+	history_      []byte
+	hash_history_ bool
+
+	/* Set by FullFlush: references may not reach before |restart_pos_|, and
+	   |restart_literals_| more bytes are to be stored uncompressed. */
+	restart_pos_      uint64
+	restart_literals_ uint32
+	restart_points_   []int64
+	total_out_        int64
+
+	/* What Stats reports, except for the output size, which is |total_out_|.
+	   |metablock_time_| is the time spent on input that is not yet in a
+	   metablock. */
+	stats_          WriterStats
+	metablock_time_ time.Duration
 }
 
+/* A distance cache entry that no distance, plus or minus the offsets of
+   the short codes, can match. */
+const unusableDistance = maxAllowedDistance + 3
+
 func inputBlockSize(s *Writer) uint {
 	return uint(1) << uint(s.params.lgblock)
 }
@@ -432,7 +459,8 @@ func chooseContextMode(params *encoderParams, data []byte, pos uint, mask uint,
 	return contextUTF8
 }
 
-func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, commands []command, saved_dist_cache []int, dist_cache []int, storage_ix *uint, storage []byte) {
+/* Also describes the metablock in |info|, leaving the sizes to the caller. */
+func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes uint, is_last bool, literal_context_mode int, params *encoderParams, prev_byte byte, prev_byte2 byte, num_literals uint, commands []command, saved_dist_cache []int, dist_cache []int, storage_ix *uint, storage []byte, info *MetablockStats) {
 	var wrapped_last_flush_pos uint32 = wrapPosition(last_flush_pos)
 	var last_bytes uint16
 	var last_bytes_bits byte
@@ -453,9 +481,16 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		copy(dist_cache, saved_dist_cache[:4])
 
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		info.Uncompressed = true
 		return
 	}
 
+	info.Commands = len(commands)
+	info.Literals = int(num_literals)
+	info.ContextMode = ContextMode(literal_context_mode)
+	info.NumBlockTypes = [3]int{1, 1, 1}
+	info.NumHistograms = [3]int{1, 1, 1}
+
 	assert(*storage_ix <= 14)
 	last_bytes = uint16(storage[1])<<8 | uint16(storage[0])
 	last_bytes_bits = byte(*storage_ix)
@@ -472,6 +507,10 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 				decideOverLiteralContextModeling(data, uint(wrapped_last_flush_pos), bytes, mask, params.quality, params.size_hint, &num_literal_contexts, &literal_context_map)
 			}
 
+			if params.search_distance_params {
+				optimizeDistanceParams(commands, &block_params)
+			}
+
 			buildMetaBlockGreedy(data, uint(wrapped_last_flush_pos), mask, prev_byte, prev_byte2, literal_context_lut, num_literal_contexts, literal_context_map, commands, mb)
 		} else {
 			buildMetaBlock(data, uint(wrapped_last_flush_pos), mask, &block_params, prev_byte, prev_byte2, commands, literal_context_mode, mb)
@@ -490,6 +529,8 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		}
 
 		storeMetaBlock(data, uint(wrapped_last_flush_pos), bytes, mask, prev_byte, prev_byte2, is_last, &block_params, literal_context_mode, commands, mb, storage_ix, storage)
+		info.NumBlockTypes = [3]int{int(mb.literal_split.num_types), int(mb.command_split.num_types), int(mb.distance_split.num_types)}
+		info.NumHistograms = [3]int{int(mb.literal_histograms_size), int(mb.command_histograms_size), int(mb.distance_histograms_size)}
 		freeMetaBlockSplit(mb)
 	}
 
@@ -501,16 +542,44 @@ func writeMetaBlockInternal(data []byte, mask uint, last_flush_pos uint64, bytes
 		storage[1] = byte(last_bytes >> 8)
 		*storage_ix = uint(last_bytes_bits)
 		storeUncompressedMetaBlock(is_last, data, uint(wrapped_last_flush_pos), mask, bytes, storage_ix, storage)
+		*info = MetablockStats{Uncompressed: true}
 	}
 }
 
+/* Font files start with one of these tags (WOFF 2.0, WOFF, TrueType,
+   OpenType/CFF, Apple TrueType and TrueType collections). */
+var kFontSignatures = [...]string{"wOF2", "wOFF", "\x00\x01\x00\x00", "OTTO", "true", "ttcf"}
+
+/* Picks an encoder mode for ::modeAuto by examining |length| bytes of input
+   starting at |pos| in the (data, mask) ring-buffer. */
+func detectMode(data []byte, pos uint, mask uint, length uint) int {
+	if length >= 4 {
+		var tag [4]byte
+		for i := uint(0); i < 4; i++ {
+			tag[i] = data[(pos+i)&mask]
+		}
+
+		for _, sig := range kFontSignatures {
+			if string(tag[:]) == sig {
+				return modeFont
+			}
+		}
+	}
+
+	if length > 0 && isMostlyUTF8(data, pos, mask, length, kMinUTF8Ratio) {
+		return modeText
+	}
+
+	return modeGeneric
+}
+
 func chooseDistanceParams(params *encoderParams) {
 	var distance_postfix_bits uint32 = 0
 	var num_direct_distance_codes uint32 = 0
 
 	if params.quality >= minQualityForNonzeroDistanceParams {
 		var ndirect_msb uint32
-		if params.mode == modeFont {
+		if params.mode == modeFont && params.dist.distance_postfix_bits == 0 && params.dist.num_direct_distance_codes == 0 {
 			distance_postfix_bits = 1
 			num_direct_distance_codes = 12
 		} else {
@@ -544,7 +613,7 @@ func ensureInitialized(s *Writer) bool {
 	ringBufferSetup(&s.params, &s.ringbuffer_)
 
 	/* Initialize last byte with stream header. */
-	{
+	if !s.continuation_ {
 		var lgwin int = int(s.params.lgwin)
 		if s.params.quality == fastOnePassCompressionQuality || s.params.quality == fastTwoPassCompressionQuality {
 			lgwin = brotli_max_int(lgwin, 18)
@@ -588,10 +657,62 @@ func ensureInitialized(s *Writer) bool {
 		s.cmd_code_numbits_ = 448
 	}
 
+	var prefix []byte = s.options.Dictionary
+	if s.options.SharedDictionary != nil && len(s.options.SharedDictionary.prefix) != 0 {
+		prefix = s.options.SharedDictionary.prefix
+	}
+	var hash bool = true
+	if s.continuation_ {
+		prefix = s.history_
+		hash = s.hash_history_
+
+		/* The decoder's distance cache holds distances from before the chunk,
+		   which are not known here. Entries that no reference can use keep the
+		   encoder from relying on them until they are replaced. */
+		for i := 0; i < 4; i++ {
+			s.dist_cache_[i] = unusableDistance
+		}
+		copy(s.saved_dist_cache_[:], s.dist_cache_[:])
+	}
+	if len(prefix) != 0 && s.params.quality != fastOnePassCompressionQuality && s.params.quality != fastTwoPassCompressionQuality {
+		encoderPrependCustomDictionary(s, prefix, hash)
+	}
+
 	s.is_initialized_ = true
 	return true
 }
 
+/* Loads the last window-size bytes of |dict| into the ring buffer and, if
+   |hash| is set, the hasher as already-processed input, so that the
+   following data can reference it. Nothing is output for it. */
+func encoderPrependCustomDictionary(s *Writer, dict []byte, hash bool) {
+	var max_backward uint = (uint(1) << s.params.lgwin) - windowGap
+	if uint(len(dict)) > max_backward {
+		dict = dict[uint(len(dict))-max_backward:]
+	}
+
+	var dict_size uint = uint(len(dict))
+	copyInputToRingBuffer(s, dict_size, dict)
+	s.last_flush_pos_ = uint64(dict_size)
+	s.last_processed_pos_ = uint64(dict_size)
+	if dict_size > 0 {
+		s.prev_byte_ = dict[dict_size-1]
+	}
+	if dict_size > 1 {
+		s.prev_byte2_ = dict[dict_size-2]
+	}
+
+	hasherSetup(&s.hasher_, &s.params, s.ringbuffer_.buffer_, 0, dict_size, false)
+	if !hash {
+		return
+	}
+	var overlap uint = s.hasher_.StoreLookahead() - 1
+	var mask uint = uint(s.ringbuffer_.mask_)
+	for i := uint(0); i+overlap < dict_size; i++ {
+		s.hasher_.Store(s.ringbuffer_.buffer_, mask, i)
+	}
+}
+
 func encoderInitParams(params *encoderParams) {
 	params.mode = defaultMode
 	params.large_window = false
@@ -600,6 +721,7 @@ func encoderInitParams(params *encoderParams) {
 	params.lgblock = 0
 	params.size_hint = 0
 	params.disable_literal_context_modeling = false
+	params.search_distance_params = false
 	initEncoderDictionary(&params.dictionary)
 	params.dist.distance_postfix_bits = 0
 	params.dist.num_direct_distance_codes = 0
@@ -624,6 +746,15 @@ func encoderInitState(s *Writer) {
 	s.stream_state_ = streamProcessing
 	s.is_last_block_emitted_ = false
 	s.is_initialized_ = false
+	s.continuation_ = false
+	s.history_ = nil
+	s.hash_history_ = false
+	s.restart_pos_ = 0
+	s.restart_literals_ = 0
+	s.restart_points_ = nil
+	s.total_out_ = 0
+	s.stats_ = WriterStats{}
+	s.metablock_time_ = 0
 
 	ringBufferInit(&s.ringbuffer_)
 
@@ -647,8 +778,27 @@ func encoderInitState(s *Writer) {
    copied to the ring buffer, otherwise the next WriteBrotliData() will fail.
 */
 func copyInputToRingBuffer(s *Writer, input_size uint, input_buffer []byte) {
+	ringBufferWrite(input_buffer, input_size, &s.ringbuffer_)
+	inputAddedToRingBuffer(s, input_size)
+}
+
+/* Returns space in the ring buffer for input, at most the rest of the
+   current input block. Filling it and passing the number of bytes to
+   commitInputToRingBuffer does what copyInputToRingBuffer does, without
+   the copy. */
+func inputSpaceInRingBuffer(s *Writer, max_size uint) []byte {
+	return ringBufferSpace(brotli_min_size_t(max_size, remainingInputBlockSize(s)), &s.ringbuffer_)
+}
+
+func commitInputToRingBuffer(s *Writer, input_size uint) {
+	ringBufferCommit(input_size, &s.ringbuffer_)
+	inputAddedToRingBuffer(s, input_size)
+}
+
+/* Accounts for |input_size| bytes of input that have just been added to the
+   ring buffer. */
+func inputAddedToRingBuffer(s *Writer, input_size uint) {
 	var ringbuffer_ *ringBuffer = &s.ringbuffer_
-	ringBufferWrite(input_buffer, input_size, ringbuffer_)
 	s.input_pos_ += uint64(input_size)
 
 	/* TL;DR: If needed, initialize 7 more bytes in the ring buffer to make the
@@ -749,6 +899,7 @@ func extendLastCommand(s *Writer, bytes *uint32, wrapped_last_processed_pos *uin
    input_block_size().
 */
 func encodeData(s *Writer, is_last bool, force_flush bool) bool {
+	var start time.Time = time.Now()
 	var delta uint64 = unprocessedInputSize(s)
 	var bytes uint32 = uint32(delta)
 	var wrapped_last_processed_pos uint32 = wrapPosition(s.last_processed_pos_)
@@ -803,6 +954,12 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 			compressFragmentTwoPass(data[wrapped_last_processed_pos&mask:], uint(bytes), is_last, s.command_buf_, s.literal_buf_, table, table_size, &storage_ix, storage)
 		}
 
+		recordMetablock(s, &MetablockStats{
+			UncompressedSize: int(bytes),
+			CompressedBits:   int64(storage_ix) - int64(s.last_bytes_bits_),
+			Last:             is_last,
+			Duration:         time.Since(start),
+		})
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
 		s.last_bytes_bits_ = byte(storage_ix & 7)
 		updateLastProcessedPos(s)
@@ -826,6 +983,24 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 		}
 	}
 
+	if s.params.mode == modeAuto && (bytes != 0 || is_last) {
+		/* The first block of input decides the mode for the whole stream. No
+		   commands have been created yet, so the distance parameters can still
+		   change. */
+		s.params.mode = detectMode(data, uint(wrapped_last_processed_pos), uint(mask), uint(bytes))
+		chooseDistanceParams(&s.params)
+	}
+
+	if s.restart_literals_ != 0 && bytes != 0 {
+		storeRestartLiterals(s, &bytes, &wrapped_last_processed_pos)
+	}
+
+	/* References may not reach before the last restart point. */
+	s.params.restart = 0
+	if delta := s.last_processed_pos_ - s.restart_pos_; delta < uint64(maxBackwardLimit(s.params.lgwin)) {
+		s.params.restart = uint(wrapped_last_processed_pos) - uint(delta)
+	}
+
 	initOrStitchToPreviousBlock(&s.hasher_, data, uint(mask), &s.params, uint(wrapped_last_processed_pos), uint(bytes), is_last)
 
 	literal_context_mode = chooseContextMode(&s.params, data, uint(wrapPosition(s.last_flush_pos_)), uint(mask), uint(s.input_pos_-s.last_flush_pos_))
@@ -861,6 +1036,7 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 				hasherReset(s.hasher_)
 			}
 
+			s.metablock_time_ += time.Since(start)
 			return true
 		}
 	}
@@ -875,6 +1051,7 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 	if !is_last && s.input_pos_ == s.last_flush_pos_ {
 		/* We have no new input data and we don't have to finish the stream, so
 		   nothing to do. */
+		s.metablock_time_ += time.Since(start)
 		return true
 	}
 
@@ -887,7 +1064,14 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 		var storage_ix uint = uint(s.last_bytes_bits_)
 		storage[0] = byte(s.last_bytes_)
 		storage[1] = byte(s.last_bytes_ >> 8)
-		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.commands, s.saved_dist_cache_[:], s.dist_cache_[:], &storage_ix, storage)
+		var info MetablockStats
+		writeMetaBlockInternal(data, uint(mask), s.last_flush_pos_, uint(metablock_size), is_last, literal_context_mode, &s.params, s.prev_byte_, s.prev_byte2_, s.num_literals_, s.commands, s.saved_dist_cache_[:], s.dist_cache_[:], &storage_ix, storage, &info)
+		info.UncompressedSize = int(metablock_size)
+		info.CompressedBits = int64(storage_ix) - int64(s.last_bytes_bits_)
+		info.Last = is_last
+		info.Duration = s.metablock_time_ + time.Since(start)
+		s.metablock_time_ = 0
+		recordMetablock(s, &info)
 		s.last_bytes_ = uint16(storage[storage_ix>>3])
 		s.last_bytes_bits_ = byte(storage_ix & 7)
 		s.last_flush_pos_ = s.input_pos_
@@ -915,6 +1099,60 @@ func encodeData(s *Writer, is_last bool, force_flush bool) bool {
 	}
 }
 
+/* Stores the first bytes after a restart point in uncompressed metablocks.
+   A decoder that starts at the restart point does not know the bytes
+   before it, which the literal context of compressed literals depends on. */
+func storeRestartLiterals(s *Writer, bytes *uint32, wrapped_last_processed_pos *uint32) {
+	var data []byte = s.ringbuffer_.buffer_
+	var mask uint32 = s.ringbuffer_.mask_
+	var start time.Time = time.Now()
+	var n uint32 = brotli_min_uint32_t(*bytes, s.restart_literals_)
+	var storage []byte = s.getStorage(int(2*n + 503))
+	var storage_ix uint = uint(s.last_bytes_bits_)
+	storage[0] = byte(s.last_bytes_)
+	storage[1] = byte(s.last_bytes_ >> 8)
+	storeUncompressedMetaBlock(false, data, uint(wrapPosition(s.last_flush_pos_)), uint(mask), uint(n), &storage_ix, storage)
+	recordMetablock(s, &MetablockStats{
+		UncompressedSize: int(n),
+		CompressedBits:   int64(storage_ix) - int64(s.last_bytes_bits_),
+		Uncompressed:     true,
+		Duration:         time.Since(start),
+	})
+	s.last_bytes_ = uint16(storage[storage_ix>>3])
+	s.last_bytes_bits_ = byte(storage_ix & 7)
+
+	s.restart_literals_ -= n
+	*bytes -= n
+	s.last_flush_pos_ += uint64(n)
+	s.last_processed_pos_ += uint64(n)
+	if wrapPosition(s.last_processed_pos_) < *wrapped_last_processed_pos {
+		hasherReset(s.hasher_)
+	}
+	*wrapped_last_processed_pos = wrapPosition(s.last_processed_pos_)
+	s.prev_byte_ = data[uint32(s.last_flush_pos_-1)&mask]
+	if s.last_flush_pos_ > 1 {
+		s.prev_byte2_ = data[uint32(s.last_flush_pos_-2)&mask]
+	}
+
+	s.writeOutput(storage[:storage_ix>>3])
+}
+
+/* Makes the encoding of the data that follows independent of what came
+   before, once the output has been flushed: it may not reference earlier
+   data, and it may not rely on the decoder's distance cache, which a
+   decoder that starts at the restart point has not filled the same way.
+   Resetting the cache to its initial values would not do, as a decoder
+   that went through the earlier data has not reset it. */
+func encoderRestart(s *Writer) {
+	s.restart_pos_ = s.input_pos_
+	s.restart_literals_ = 2
+	for i := 0; i < 4; i++ {
+		s.dist_cache_[i] = unusableDistance
+	}
+	copy(s.saved_dist_cache_[:], s.dist_cache_[:])
+	s.restart_points_ = append(s.restart_points_, s.total_out_)
+}
+
 /* Dumps remaining output bits and metadata header to |header|.
    Returns number of produced bytes.
    REQUIRED: |header| should be 8-byte aligned and at least 16 bytes long.
@@ -934,7 +1172,7 @@ func writeMetadataHeader(s *Writer, block_size uint, header []byte) uint {
 	} else {
 		var nbits uint32
 		if block_size == 1 {
-			nbits = 0
+			nbits = 1
 		} else {
 			nbits = log2FloorNonZero(uint(uint32(block_size)-1)) + 1
 		}
@@ -956,6 +1194,7 @@ func injectBytePaddingBlock(s *Writer) {
 	seal |= 0x6 << seal_bits
 
 	seal_bits += 6
+	recordMetablock(s, &MetablockStats{CompressedBits: int64((seal_bits+7)&^7) - int64(seal_bits-6), Metadata: true})
 
 	destination := s.tiny_buf_.u8[:]
 
@@ -1021,6 +1260,7 @@ func encoderCompressStreamFast(s *Writer, op int, available_in *uint, next_in *[
 				continue
 			}
 
+			var start time.Time = time.Now()
 			storage = s.getStorage(int(max_out_size))
 
 			storage[0] = byte(s.last_bytes_)
@@ -1035,6 +1275,12 @@ func encoderCompressStreamFast(s *Writer, op int, available_in *uint, next_in *[
 
 			*next_in = (*next_in)[block_size:]
 			*available_in -= block_size
+			recordMetablock(s, &MetablockStats{
+				UncompressedSize: int(block_size),
+				CompressedBits:   int64(storage_ix) - int64(s.last_bytes_bits_),
+				Last:             is_last,
+				Duration:         time.Since(start),
+			})
 			var out_bytes uint = storage_ix >> 3
 			s.writeOutput(storage[:out_bytes])
 
@@ -1087,7 +1333,13 @@ func processMetadata(s *Writer, available_in *uint, next_in *[]byte) bool {
 		}
 
 		if s.stream_state_ == streamMetadataHead {
+			var header_bits int64 = -int64(s.last_bytes_bits_)
 			n := writeMetadataHeader(s, uint(s.remaining_metadata_bytes_), s.tiny_buf_.u8[:])
+			recordMetablock(s, &MetablockStats{
+				CompressedBits: header_bits + 8*int64(n) + 8*int64(s.remaining_metadata_bytes_),
+				MetadataSize:   int(s.remaining_metadata_bytes_),
+				Metadata:       true,
+			})
 			s.writeOutput(s.tiny_buf_.u8[:n])
 			s.stream_state_ = streamMetadataBody
 			continue
@@ -1115,6 +1367,16 @@ func processMetadata(s *Writer, available_in *uint, next_in *[]byte) bool {
 	return true
 }
 
+/* Limits a size hint to 1 GiB; larger inputs are not treated differently. */
+func clampSizeHint(size uint64) uint {
+	const limit uint64 = 1 << 30
+	if size >= limit {
+		return uint(limit)
+	}
+
+	return uint(size)
+}
+
 func updateSizeHint(s *Writer, available_in uint) {
 	if s.params.size_hint == 0 {
 		var delta uint64 = unprocessedInputSize(s)
@@ -1208,12 +1470,71 @@ func encoderCompressStream(s *Writer, op int, available_in *uint, next_in *[]byt
 	return true
 }
 
+/* Compresses all of |input| as a single stream, as the reference encoder's
+   one-shot BrotliCompressBufferQuality10 does: the input is used in place
+   of the ring buffer instead of being copied to it block by block, and the
+   hasher is prepared knowing that it will see nothing else.
+   The hasher of the zopflification qualities never reads past the last
+   byte of the data; the others read up to 7 bytes past it, so they get a
+   copy of the input with zeroed slack, like that of the ring buffer. The
+   fast qualities read their input in place anyway, and are left to the
+   stream API.
+   Returns false if compression fails; if the input cannot be compressed
+   this way, that happens before the encoder is initialized, and the stream
+   API can be used instead. */
+func encoderCompressOneShot(s *Writer, input []byte) bool {
+	if s.is_initialized_ || uint64(len(input)) > 1<<30 {
+		return false
+	}
+	if len(s.options.Dictionary) != 0 || (s.options.SharedDictionary != nil && len(s.options.SharedDictionary.prefix) != 0) {
+		return false
+	}
+	sanitizeParams(&s.params)
+	if s.params.quality <= fastTwoPassCompressionQuality {
+		return false
+	}
+	if !ensureInitialized(s) {
+		return false
+	}
+	if s.params.size_hint == 0 {
+		s.params.size_hint = clampSizeHint(uint64(len(input)))
+	}
+
+	var data []byte = input
+	if s.params.quality < zopflificationQuality {
+		data = make([]byte, uint(len(input))+kSlackForEightByteHashingEverywhere)
+		copy(data, input)
+	}
+
+	/* Positions up to 1 GiB are not wrapped, so they index the data. */
+	s.ringbuffer_.buffer_ = data
+	s.ringbuffer_.mask_ = 1<<31 - 1
+	hasherSetup(&s.hasher_, &s.params, data, 0, uint(len(input)), true)
+
+	for {
+		var block_size uint = brotli_min_size_t(inputBlockSize(s), uint(uint64(len(input))-s.input_pos_))
+		s.input_pos_ += uint64(block_size)
+		var is_last bool = s.input_pos_ == uint64(len(input))
+		if !encodeData(s, is_last, false) {
+			return false
+		}
+		if is_last {
+			break
+		}
+	}
+
+	s.stream_state_ = streamFinished
+	return true
+}
+
 func (w *Writer) writeOutput(data []byte) {
 	if w.err != nil {
 		return
 	}
 
-	_, w.err = w.dst.Write(data)
+	var n int
+	n, w.err = w.dst.Write(data)
+	w.total_out_ += int64(n)
 	if w.err == nil {
 		checkFlushComplete(w)
 	}
@@ -3,6 +3,7 @@ package brotli
 /* Dictionary data (words and transforms) for 1 possible context */
 type encoderDictionary struct {
 	words                 *dictionary
+	transforms            *transforms
 	cutoffTransformsCount uint32
 	cutoffTransforms      uint64
 	hash_table            []uint16
@@ -12,6 +13,7 @@ type encoderDictionary struct {
 
 func initEncoderDictionary(dict *encoderDictionary) {
 	dict.words = getDictionary()
+	dict.transforms = getTransforms()
 
 	dict.hash_table = kStaticDictionaryHash[:]
 	dict.buckets = kStaticDictionaryBuckets[:]
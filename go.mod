@@ -1,8 +1,9 @@
 module github.com/qydysky/brotli
+
 // module github.com/andybalholm/brotli
 
 go 1.21
 
 retract v1.0.1 // occasional panics and data corruption
 
-require github.com/xyproto/randomstring v1.0.5 // indirect
+require github.com/xyproto/randomstring v1.0.5
@@ -205,7 +205,7 @@ func findAllMatchesH10(handle *h10, dictionary *encoderDictionary, data []byte,
 	}
 	{
 		var minlen uint = brotli_max_size_t(4, best_len+1)
-		if findAllStaticDictionaryMatches(dictionary, data[cur_ix_masked:], minlen, max_length, dict_matches[0:]) {
+		if dictionary != nil && findAllStaticDictionaryMatches(dictionary, data[cur_ix_masked:], minlen, max_length, dict_matches[0:]) {
 			var maxlen uint = brotli_min_size_t(maxStaticDictionaryMatchLen, max_length)
 			var l uint
 			for l = minlen; l <= maxlen; l++ {
@@ -162,7 +162,7 @@ func searchInStaticDictionary(dictionary *encoderDictionary, handle hasherHandle
 	var key uint
 	var i uint
 	var self *hasherCommon = handle.Common()
-	if self.dict_num_matches < self.dict_num_lookups>>7 {
+	if dictionary == nil || self.dict_num_matches < self.dict_num_lookups>>7 {
 		return
 	}
 
@@ -30,9 +30,10 @@ func (h *hashComposite) StoreLookahead() uint {
    and HASHER_B. */
 type hashComposite struct {
 	hasherCommon
-	ha     hasherHandle
-	hb     hasherHandle
-	params *encoderParams
+	ha          hasherHandle
+	hb          hasherHandle
+	params      *encoderParams
+	initialized bool
 }
 
 func (h *hashComposite) Initialize(params *encoderParams) {
@@ -44,7 +45,7 @@ func (h *hashComposite) Initialize(params *encoderParams) {
    here that are needed to know the memory size of them. Instead provide
    those params to all hashers InitializehashComposite */
 func (h *hashComposite) Prepare(one_shot bool, input_size uint, data []byte) {
-	if h.ha == nil {
+	if !h.initialized {
 		var common_a *hasherCommon
 		var common_b *hasherCommon
 
@@ -61,6 +62,7 @@ func (h *hashComposite) Prepare(one_shot bool, input_size uint, data []byte) {
 		common_b.dict_num_lookups = 0
 		common_b.dict_num_matches = 0
 		h.hb.Initialize(h.params)
+		h.initialized = true
 	}
 
 	h.ha.Prepare(one_shot, input_size, data)
@@ -0,0 +1,201 @@
+package brotli
+
+import (
+	"io"
+	"strconv"
+)
+
+// A ContextMode selects how the literal context of a literal block type is
+// computed from the two preceding bytes.
+type ContextMode int
+
+const (
+	ContextLSB6   ContextMode = contextLSB6
+	ContextMSB6   ContextMode = contextMSB6
+	ContextUTF8   ContextMode = contextUTF8
+	ContextSigned ContextMode = contextSigned
+)
+
+func (m ContextMode) String() string {
+	switch m {
+	case ContextLSB6:
+		return "LSB6"
+	case ContextMSB6:
+		return "MSB6"
+	case ContextUTF8:
+		return "UTF8"
+	case ContextSigned:
+		return "Signed"
+	}
+	return "ContextMode(" + strconv.Itoa(int(m)) + ")"
+}
+
+// StreamInfo describes a brotli stream, as reported by Inspect.
+type StreamInfo struct {
+	// WindowBits is the base 2 logarithm of the window size.
+	WindowBits int
+	// LargeWindow reports whether the stream uses the large window
+	// extension.
+	LargeWindow bool
+	// CompressedSize and UncompressedSize are the sizes of the stream in
+	// bytes, as far as it was inspected.
+	CompressedSize   int64
+	UncompressedSize int64
+}
+
+// MetablockInfo describes a metablock, as reported by Inspect.
+type MetablockInfo struct {
+	// Offset and CompressedBits locate the metablock, header included, in
+	// the compressed stream. They are counted in bits, because metablocks
+	// need not start or end on a byte boundary.
+	Offset         int64
+	CompressedBits int64
+	// UncompressedSize is the number of bytes the metablock decodes to.
+	UncompressedSize int
+	// MetadataSize is the length of the metadata of a metadata block.
+	MetadataSize int
+
+	Last         bool
+	Uncompressed bool
+	Metadata     bool
+
+	// The rest is only set for compressed metablocks.
+
+	// NumBlockTypes holds the number of literal, insert-and-copy and
+	// distance block types.
+	NumBlockTypes [3]int
+	// ContextModes holds the context mode of each literal block type.
+	ContextModes []ContextMode
+	// NPostfix and NDirect are the distance parameters NPOSTFIX and NDIRECT.
+	NPostfix int
+	NDirect  int
+	// NumTrees holds the number of literal, insert-and-copy and distance
+	// Huffman trees.
+	NumTrees [3]int
+	// Commands holds the commands of the metablock if
+	// InspectOptions.Commands is set.
+	Commands []CommandInfo
+}
+
+// CommandInfo describes a command of a compressed metablock.
+type CommandInfo struct {
+	// Insert is the number of literals the command inserts.
+	Insert int
+	// Copy is the length of the backward reference that follows the
+	// literals, or 0 if the command only inserts literals, which the last
+	// command of a metablock may do.
+	Copy int
+	// Distance is the backward distance of the reference. If Dictionary is
+	// set, it is beyond the window and refers to a static dictionary word
+	// instead.
+	Distance   int
+	Dictionary bool
+}
+
+// InspectOptions configures InspectWithOptions.
+type InspectOptions struct {
+	// Commands makes Inspect report the commands of each metablock in
+	// MetablockInfo.Commands.
+	Commands bool
+
+	// ReaderOptions are used to decode the stream, for example to supply
+	// the dictionary it was compressed with. LargeWindow is always enabled
+	// and Multistream is ignored.
+	ReaderOptions ReaderOptions
+}
+
+// Inspect reads a brotli stream from src and reports its window size and
+// the layout of each of its metablocks. Compressed metablocks carry no
+// length in the compressed stream, so they must be decoded to find where
+// the next one starts, but the decoded data is discarded.
+//
+// If the stream is corrupt, Inspect returns the metablocks it got through
+// along with the error.
+func Inspect(src io.Reader) ([]MetablockInfo, StreamInfo, error) {
+	return InspectWithOptions(src, InspectOptions{})
+}
+
+// InspectWithOptions is like Inspect but specifies InspectOptions.
+func InspectWithOptions(src io.Reader, options InspectOptions) ([]MetablockInfo, StreamInfo, error) {
+	ropts := options.ReaderOptions
+	ropts.LargeWindow = true
+	ropts.Multistream = false
+	r := NewReaderOptions(src, ropts)
+	in := &inspector{commands: options.Commands}
+	r.inspector = in
+
+	_, err := r.WriteTo(io.Discard)
+	in.stream.CompressedSize = r.InputOffset()
+	in.stream.UncompressedSize = r.OutputOffset()
+	return in.metablocks, in.stream, err
+}
+
+/* Collects what Inspect reports while the decoder runs. */
+type inspector struct {
+	commands   bool
+	stream     StreamInfo
+	metablocks []MetablockInfo
+}
+
+/* Returns the number of compressed bits the decoder has consumed;
+   |available_in| is the input it was handed that is not buffered yet. */
+func inspectBitOffset(s *Reader, available_in uint) int64 {
+	var bytes int64 = s.total_in - int64(available_in) - int64(s.buffer_length) + int64(s.br.byte_pos)
+	return bytes*8 - int64(getAvailableBits(&s.br))
+}
+
+func (in *inspector) current() *MetablockInfo {
+	return &in.metablocks[len(in.metablocks)-1]
+}
+
+func (in *inspector) metablockBegin(s *Reader, available_in uint) {
+	in.metablocks = append(in.metablocks, MetablockInfo{Offset: inspectBitOffset(s, available_in)})
+}
+
+func (in *inspector) metablockHeader(s *Reader) {
+	var m *MetablockInfo = in.current()
+	m.Last = s.is_last_metablock != 0
+	m.Uncompressed = s.is_uncompressed != 0
+	m.Metadata = s.is_metadata != 0
+	if m.Metadata {
+		m.MetadataSize = s.meta_block_remaining_len
+	} else {
+		m.UncompressedSize = s.meta_block_remaining_len
+	}
+}
+
+func (in *inspector) metablockTrees(s *Reader) {
+	var m *MetablockInfo = in.current()
+	for i := 0; i < 3; i++ {
+		m.NumBlockTypes[i] = int(s.num_block_types[i])
+	}
+	m.ContextModes = make([]ContextMode, len(s.context_modes))
+	for i, mode := range s.context_modes {
+		m.ContextModes[i] = ContextMode(mode)
+	}
+	m.NPostfix = int(s.distance_postfix_bits)
+	m.NDirect = int(s.num_direct_distance_codes - numDistanceShortCodes)
+	m.NumTrees = [3]int{int(s.num_literal_htrees), int(s.num_block_types[1]), int(s.num_dist_htrees)}
+}
+
+func (in *inspector) metablockEnd(s *Reader, available_in uint) {
+	var m *MetablockInfo = in.current()
+	m.CompressedBits = inspectBitOffset(s, available_in) - m.Offset
+}
+
+func (in *inspector) command(insert int) {
+	if in.commands {
+		m := in.current()
+		m.Commands = append(m.Commands, CommandInfo{Insert: insert})
+	}
+}
+
+func (in *inspector) distance(s *Reader) {
+	if in.commands {
+		m := in.current()
+		c := &m.Commands[len(m.Commands)-1]
+		c.Copy = s.copy_length
+		c.Distance = s.distance_code
+		c.Dictionary = s.distance_code > s.max_distance
+	}
+}
@@ -0,0 +1,52 @@
+// Package readersize finds out how much data is left in an io.Reader,
+// for the ReadFrom methods of the brotli and matchfinder Writers.
+package readersize
+
+import (
+	"io"
+	"os"
+)
+
+// Remaining returns the number of bytes left to read from r, if r is a
+// reader that can tell: one with a Len method, such as a *bytes.Reader, an
+// *io.LimitedReader, or a seekable regular file or reader with a Size
+// method, such as an *io.SectionReader.
+func Remaining(r io.Reader) (int64, bool) {
+	var size, pos int64
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case *io.LimitedReader:
+		size = r.N
+		if inner, ok := Remaining(r.R); ok && inner < size {
+			size = inner
+		}
+	case interface {
+		Stat() (os.FileInfo, error)
+		io.Seeker
+	}:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		if pos, err = r.Seek(0, io.SeekCurrent); err != nil {
+			return 0, false
+		}
+		size = info.Size() - pos
+	case interface {
+		Size() int64
+		io.Seeker
+	}:
+		var err error
+		if pos, err = r.Seek(0, io.SeekCurrent); err != nil {
+			return 0, false
+		}
+		size = r.Size() - pos
+	default:
+		return 0, false
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size, true
+}
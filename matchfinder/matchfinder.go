@@ -10,7 +10,12 @@
 // representation to allow mixing and matching compression components.
 package matchfinder
 
-import "io"
+import (
+	"io"
+	"time"
+
+	"github.com/qydysky/brotli/internal/readersize"
+)
 
 // A Match is the basic unit of LZ77 compression.
 type Match struct {
@@ -54,6 +59,25 @@ type Writer struct {
 	inBuf   []byte
 	outBuf  []byte
 	matches []Match
+	stats   Stats
+}
+
+// Stats reports what a Writer has done since it was created or Reset, as
+// returned by Writer.Stats.
+type Stats struct {
+	// BytesIn is the number of bytes written to the Writer, and BytesOut
+	// the number of bytes it has written to Dest.
+	BytesIn  int64
+	BytesOut int64
+	// Blocks is the number of blocks compressed.
+	Blocks int
+	// Duration is the time spent finding matches and encoding.
+	Duration time.Duration
+}
+
+// Stats returns statistics about the work the Writer has done.
+func (w *Writer) Stats() Stats {
+	return w.stats
 }
 
 func (w *Writer) Write(p []byte) (n int, err error) {
@@ -61,6 +85,7 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 		return 0, w.err
 	}
 
+	w.stats.BytesIn += int64(len(p))
 	if w.BlockSize == 0 {
 		return w.writeBlock(p, false)
 	}
@@ -78,11 +103,73 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return len(p), w.err
 }
 
+// copyBlockSize is the block size ReadFrom uses when BlockSize is zero: the
+// size of the writes io.Copy would make.
+const copyBlockSize = 32 << 10
+
+// ReadFrom implements io.ReaderFrom. It reads from r until EOF or an error,
+// directly into the buffer where input waits to be compressed, instead of
+// into a buffer of io.Copy's that Write would copy from. If r can tell how
+// much data it holds, the buffer is no larger than needed.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	blockSize := w.BlockSize
+	if blockSize == 0 {
+		blockSize = copyBlockSize
+	}
+	size, sized := readersize.Remaining(r)
+
+	for {
+		if len(w.inBuf) == cap(w.inBuf) {
+			// Room for one byte more than r is expected to hold finds its end.
+			capacity := blockSize
+			if sized && n <= size && int64(len(w.inBuf))+size-n < int64(capacity) {
+				capacity = len(w.inBuf) + int(size-n) + 1
+			}
+			newBuf := make([]byte, len(w.inBuf), capacity)
+			copy(newBuf, w.inBuf)
+			w.inBuf = newBuf
+		}
+
+		end := cap(w.inBuf)
+		if end > blockSize {
+			end = blockSize
+		}
+		m, err := r.Read(w.inBuf[len(w.inBuf):end])
+		w.inBuf = w.inBuf[:len(w.inBuf)+m]
+		n += int64(m)
+		w.stats.BytesIn += int64(m)
+
+		// Without a BlockSize, Write compresses each call's data right away,
+		// so nothing may be left in inBuf for it.
+		if len(w.inBuf) == blockSize || (w.BlockSize == 0 && err != nil && len(w.inBuf) > 0) {
+			w.writeBlock(w.inBuf, false)
+			w.inBuf = w.inBuf[:0]
+			if w.err != nil {
+				return n, w.err
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 func (w *Writer) writeBlock(p []byte, lastBlock bool) (n int, err error) {
+	start := time.Now()
 	w.outBuf = w.outBuf[:0]
 	w.matches = w.MatchFinder.FindMatches(w.matches[:0], p)
 	w.outBuf = w.Encoder.Encode(w.outBuf, p, w.matches, lastBlock)
-	_, w.err = w.Dest.Write(w.outBuf)
+	w.stats.Blocks++
+	w.stats.Duration += time.Since(start)
+	n, w.err = w.Dest.Write(w.outBuf)
+	w.stats.BytesOut += int64(n)
 	return len(p), w.err
 }
 
@@ -99,5 +186,6 @@ func (w *Writer) Reset(newDest io.Writer) {
 	w.inBuf = w.inBuf[:0]
 	w.outBuf = w.outBuf[:0]
 	w.matches = w.matches[:0]
+	w.stats = Stats{}
 	w.Dest = newDest
 }
@@ -0,0 +1,103 @@
+package matchfinder
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// blockRecorder is an Encoder that outputs its input unchanged and records
+// the size of each block.
+type blockRecorder struct {
+	blocks []int
+}
+
+func (b *blockRecorder) Reset() { b.blocks = nil }
+
+func (b *blockRecorder) Encode(dst []byte, src []byte, matches []Match, lastBlock bool) []byte {
+	b.blocks = append(b.blocks, len(src))
+	return append(dst, src...)
+}
+
+func newRecordingWriter(dst io.Writer, blockSize int) (*Writer, *blockRecorder) {
+	b := new(blockRecorder)
+	return &Writer{Dest: dst, MatchFinder: NoMatchFinder{}, Encoder: b, BlockSize: blockSize}, b
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	input := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(input)
+	for _, blockSize := range []int{0, 1000, 1 << 16} {
+		for _, newReader := range []func(p []byte) io.Reader{
+			func(p []byte) io.Reader { return bytes.NewReader(p) },
+			func(p []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(p)) },
+			func(p []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(p)) },
+			func(p []byte) io.Reader {
+				return &io.LimitedReader{R: strings.NewReader(string(p) + "extra"), N: int64(len(p))}
+			},
+		} {
+			var want bytes.Buffer
+			ww, wantBlocks := newRecordingWriter(&want, blockSize)
+			ww.Write(input[:300])
+			ww.Write(input[300:])
+			ww.Close()
+
+			// ReadFrom carries on from data buffered by Write, and cuts the
+			// same blocks as Write does.
+			var got bytes.Buffer
+			w, gotBlocks := newRecordingWriter(&got, blockSize)
+			w.Write(input[:300])
+			n, err := w.ReadFrom(newReader(input[300:]))
+			if err != nil || n != int64(len(input)-300) {
+				t.Fatalf("BlockSize %d: ReadFrom = %d, %v; want %d, nil", blockSize, n, err, len(input)-300)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), input) {
+				t.Fatalf("BlockSize %d: output does not match input", blockSize)
+			}
+			if blockSize != 0 && !reflect.DeepEqual(gotBlocks.blocks, wantBlocks.blocks) {
+				t.Errorf("BlockSize %d: ReadFrom made blocks %v, Write made %v", blockSize, gotBlocks.blocks, wantBlocks.blocks)
+			}
+			for _, size := range gotBlocks.blocks {
+				if blockSize == 0 && size > copyBlockSize {
+					t.Errorf("BlockSize 0: ReadFrom made a block of %d bytes, more than %d", size, copyBlockSize)
+				}
+			}
+		}
+	}
+}
+
+func TestWriterReadFromSmall(t *testing.T) {
+	input := []byte("a few bytes of input")
+	for _, blockSize := range []int{0, 1000} {
+		var out bytes.Buffer
+		w, blocks := newRecordingWriter(&out, blockSize)
+		if _, err := w.ReadFrom(bytes.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		// A reader that can tell its size gets a buffer just large enough
+		// to see its end.
+		if cap(w.inBuf) > len(input)+1 {
+			t.Errorf("BlockSize %d: buffer of %d bytes for %d bytes of input", blockSize, cap(w.inBuf), len(input))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), input) {
+			t.Errorf("BlockSize %d: output does not match input", blockSize)
+		}
+		want := []int{len(input), 0}
+		if blockSize != 0 {
+			want = []int{len(input)}
+		}
+		if !reflect.DeepEqual(blocks.blocks, want) {
+			t.Errorf("BlockSize %d: got blocks %v, want %v", blockSize, blocks.blocks, want)
+		}
+	}
+}
@@ -137,21 +137,15 @@ func computeDistanceCost(cmds []command, orig_params *distanceParams, new_params
 
 var buildMetaBlock_kMaxNumberOfHistograms uint = 256
 
-func buildMetaBlock(ringbuffer []byte, pos uint, mask uint, params *encoderParams, prev_byte byte, prev_byte2 byte, cmds []command, literal_context_mode int, mb *metaBlockSplit) {
-	var distance_histograms []histogramDistance
-	var literal_histograms []histogramLiteral
-	var literal_context_modes []int = nil
-	var literal_histograms_size uint
-	var distance_histograms_size uint
-	var i uint
-	var literal_context_multiplier uint = 1
+/* Searches for the distance parameters (NPOSTFIX, NDIRECT) that minimize the
+   cost of the distances in |cmds|, stores them in params.dist and re-encodes
+   the distance prefixes of |cmds| accordingly. */
+func optimizeDistanceParams(cmds []command, params *encoderParams) {
 	var npostfix uint32
 	var ndirect_msb uint32 = 0
 	var check_orig bool = true
 	var best_dist_cost float64 = 1e99
 	var orig_params encoderParams = *params
-	/* Histogram ids need to fit in one byte. */
-
 	var new_params encoderParams = *params
 
 	for npostfix = 0; npostfix <= maxNpostfix; npostfix++ {
@@ -190,6 +184,19 @@ func buildMetaBlock(ringbuffer []byte, pos uint, mask uint, params *encoderParam
 	}
 
 	recomputeDistancePrefixes(cmds, &orig_params.dist, &params.dist)
+}
+
+func buildMetaBlock(ringbuffer []byte, pos uint, mask uint, params *encoderParams, prev_byte byte, prev_byte2 byte, cmds []command, literal_context_mode int, mb *metaBlockSplit) {
+	var distance_histograms []histogramDistance
+	var literal_histograms []histogramLiteral
+	var literal_context_modes []int = nil
+	var literal_histograms_size uint
+	var distance_histograms_size uint
+	var i uint
+	var literal_context_multiplier uint = 1
+	/* Histogram ids need to fit in one byte. */
+
+	optimizeDistanceParams(cmds, params)
 
 	splitBlock(cmds, ringbuffer, pos, mask, params, &mb.literal_split, &mb.command_split, &mb.distance_split)
 
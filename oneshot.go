@@ -0,0 +1,118 @@
+package brotli
+
+import (
+	"bytes"
+	"io"
+)
+
+// MaxEncodedLen returns the largest number of bytes that EncodeAll can
+// produce for n bytes of input, as BrotliEncoderMaxCompressedSize does in
+// the reference library. It returns -1 if n is negative or the bound would
+// overflow an int.
+func MaxEncodedLen(n int) int {
+	if n < 0 {
+		return -1
+	}
+	if n == 0 {
+		return 2
+	}
+
+	/* [window bits / empty metadata] + N * [uncompressed] + [last empty] */
+	var num_large_blocks int = n >> 14
+	var overhead int = 2 + (4 * num_large_blocks) + 3 + 1
+	var result int = n + overhead
+	if result < n {
+		return -1
+	}
+	return result
+}
+
+// EncodeAll compresses src with the given options and appends the result
+// to dst, returning the extended slice. Without a prefix dictionary, the
+// encoder sees all of src at once rather than block by block through its
+// window as a Writer does; at qualities 10 and 11 it reads src in place.
+// The output is never longer than MaxEncodedLen(len(src)): if compression
+// would make it longer, the data is stored uncompressed.
+func EncodeAll(dst, src []byte, options WriterOptions) ([]byte, error) {
+	var start int = len(dst)
+	out := bytes.NewBuffer(dst)
+	var w Writer
+	w.options = options
+	w.Reset(out)
+	if w.err != nil {
+		return dst, w.err
+	}
+
+	if !encoderCompressOneShot(&w, src) {
+		if w.is_initialized_ {
+			return dst, errEncode
+		}
+		if _, err := w.Write(src); err != nil {
+			return dst, err
+		}
+		if err := w.Close(); err != nil {
+			return dst, err
+		}
+	}
+
+	var result []byte = out.Bytes()
+	if limit := MaxEncodedLen(len(src)); limit >= 0 && len(result)-start > limit {
+		result = makeUncompressedStream(result[:start], src)
+	}
+	return result, nil
+}
+
+/* Appends a stream that stores |input| in uncompressed metablocks, as the
+   reference encoder does when compression does not pay off. */
+func makeUncompressedStream(dst []byte, input []byte) []byte {
+	if len(input) == 0 {
+		return append(dst, 6)
+	}
+
+	/* Window bits 10, then an empty metadata block that ends the byte. */
+	dst = append(dst, 0x21, 0x03)
+	for len(input) > 0 {
+		var nibbles uint32 = 0
+		var chunk_size uint32 = 1 << 24
+		if uint(len(input)) < uint(chunk_size) {
+			chunk_size = uint32(len(input))
+		}
+		if chunk_size > 1<<16 {
+			if chunk_size > 1<<20 {
+				nibbles = 2
+			} else {
+				nibbles = 1
+			}
+		}
+
+		var bits uint32 = nibbles<<1 | (chunk_size-1)<<3 | 1<<(19+4*nibbles)
+		dst = append(dst, byte(bits), byte(bits>>8), byte(bits>>16))
+		if nibbles == 2 {
+			dst = append(dst, byte(bits>>24))
+		}
+		dst = append(dst, input[:chunk_size]...)
+		input = input[chunk_size:]
+	}
+
+	/* ISLAST and ISEMPTY. */
+	return append(dst, 3)
+}
+
+// DecodeAll decompresses src, which must hold a complete brotli stream,
+// and appends the result to dst, returning the extended slice.
+func DecodeAll(dst, src []byte) ([]byte, error) {
+	r := NewReader(bytes.NewReader(src))
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
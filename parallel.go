@@ -0,0 +1,236 @@
+package brotli
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+)
+
+/* Parallel compression
+
+   The input is cut into chunks that are compressed by separate encoders
+   and concatenated into a single stream. Each chunk is flushed, so that it
+   ends on a byte boundary and the next one can start there; only the first
+   writes the stream header, and only the last ends the stream.
+
+   The decoder decodes the chunks as one, so each encoder must encode as if
+   it had produced everything before its chunk. It gets the window of data
+   before the chunk in place of a dictionary: this puts the chunk at the
+   position the decoder sees it at (which matters beyond back-references,
+   as static dictionary references are encoded as distances past the start
+   of the data) and keeps the literal context of its first bytes right. The
+   decoder's distance cache cannot be known, so the encoder starts with one
+   it cannot use. */
+
+const defaultParallelChunkSize = 4 << 20
+
+// ParallelOptions configures how a ParallelWriter divides up the work.
+type ParallelOptions struct {
+	// Concurrency is the number of chunks compressed at the same time.
+	// 0 means runtime.GOMAXPROCS(0).
+	Concurrency int
+	// ChunkSize is the number of bytes of input compressed by each
+	// goroutine. 0 means 4 MiB. Smaller chunks put more goroutines to work
+	// on small inputs, but compress worse.
+	ChunkSize int
+	// History makes the encoder of each chunk hash the window of data
+	// before it, so that back-references can reach across chunk boundaries
+	// as they do in a stream compressed by a single Writer. This compresses
+	// better, at the cost of hashing the window again for every chunk.
+	// It has no effect at qualities 0 and 1, which never refer back to
+	// earlier blocks.
+	History bool
+}
+
+// A ParallelWriter compresses data on several goroutines. The output is a
+// single brotli stream, which any Reader decodes; it is a little larger
+// than a Writer's, as the chunks compressed separately end on a byte
+// boundary and do not share some encoder state.
+type ParallelWriter struct {
+	dst          io.Writer
+	options      WriterOptions
+	concurrency  int
+	chunk_size   int
+	history      bool
+	max_backward int
+
+	buf     []byte
+	window  []byte
+	started bool
+	pending []*parallelChunk
+	err     error
+}
+
+type parallelChunk struct {
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// NewParallelWriter returns a ParallelWriter that compresses to dst with
+// the given options. Input is buffered until a chunk is complete, and the
+// output of a chunk is written once it and all chunks before it are done.
+// It is the caller's responsibility to call Close on the ParallelWriter
+// when done.
+func NewParallelWriter(dst io.Writer, options WriterOptions, parallel ParallelOptions) *ParallelWriter {
+	w := &ParallelWriter{
+		dst:         dst,
+		options:     options,
+		concurrency: parallel.Concurrency,
+		chunk_size:  parallel.ChunkSize,
+		history:     parallel.History,
+	}
+	if w.concurrency <= 0 {
+		w.concurrency = runtime.GOMAXPROCS(0)
+	}
+	if w.chunk_size <= 0 {
+		w.chunk_size = defaultParallelChunkSize
+	}
+
+	/* The window the encoders will use, and the dictionary at its start. */
+	var e Writer
+	e.options = options
+	e.Reset(nil)
+	sanitizeParams(&e.params)
+	if e.params.quality != fastOnePassCompressionQuality && e.params.quality != fastTwoPassCompressionQuality {
+		w.max_backward = int(maxBackwardLimit(e.params.lgwin))
+		var prefix []byte = options.Dictionary
+		if options.SharedDictionary != nil && len(options.SharedDictionary.prefix) != 0 {
+			prefix = options.SharedDictionary.prefix
+		}
+		w.window = parallelWindow(nil, prefix, w.max_backward)
+	}
+	return w
+}
+
+// Write implements io.Writer.
+func (w *ParallelWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.chunk_size)
+		}
+		var m int = w.chunk_size - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		n += m
+		p = p[m:]
+		if len(w.buf) == w.chunk_size {
+			if err := w.startChunk(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush compresses all buffered input and writes out the output of every
+// chunk, so that everything written so far can be decoded. Each Flush ends
+// a chunk, which costs some compression.
+func (w *ParallelWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) != 0 {
+		if err := w.startChunk(false); err != nil {
+			return err
+		}
+	}
+	for len(w.pending) != 0 {
+		if err := w.finishChunk(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close compresses the remaining input, ends the stream and waits for the
+// output to be written.
+func (w *ParallelWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.startChunk(true); err != nil {
+		return err
+	}
+	for len(w.pending) != 0 {
+		if err := w.finishChunk(); err != nil {
+			return err
+		}
+	}
+	w.err = errWriterClosed
+	return nil
+}
+
+/* Starts compressing the buffered input, which may be empty for the last
+   chunk, on a new goroutine. If as many chunks as allowed are in progress,
+   the oldest is waited for first. */
+func (w *ParallelWriter) startChunk(last bool) error {
+	if len(w.pending) == w.concurrency {
+		if err := w.finishChunk(); err != nil {
+			return err
+		}
+	}
+
+	c := &parallelChunk{done: make(chan struct{})}
+	e := NewWriterOptions(&c.out, w.options)
+	if w.started {
+		e.continuation_ = true
+		e.history_ = w.window
+		e.hash_history_ = w.history
+	}
+	var data []byte = w.buf
+	w.buf = nil
+	w.started = true
+	if w.max_backward != 0 {
+		w.window = parallelWindow(w.window, data, w.max_backward)
+	}
+	w.pending = append(w.pending, c)
+
+	go func() {
+		defer close(c.done)
+		if _, c.err = e.Write(data); c.err != nil {
+			return
+		}
+		if last {
+			c.err = e.Close()
+		} else {
+			c.err = e.Flush()
+		}
+	}()
+	return nil
+}
+
+/* Waits for the oldest chunk in progress and writes its output. */
+func (w *ParallelWriter) finishChunk() error {
+	var c *parallelChunk = w.pending[0]
+	<-c.done
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	if c.err != nil {
+		w.err = c.err
+		return w.err
+	}
+	_, w.err = w.dst.Write(c.out.Bytes())
+	return w.err
+}
+
+/* Returns the last |size| bytes of |window| followed by |data|. The result
+   is not modified later, as encoders still running may hold it, so it is
+   built in a new slice unless it lies within |data|. */
+func parallelWindow(window []byte, data []byte, size int) []byte {
+	if len(data) >= size {
+		return data[len(data)-size:]
+	}
+	var keep int = size - len(data)
+	if keep > len(window) {
+		keep = len(window)
+	}
+	var next []byte = make([]byte, 0, keep+len(data))
+	next = append(next, window[len(window)-keep:]...)
+	return append(next, data...)
+}
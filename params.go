@@ -30,8 +30,13 @@ type encoderParams struct {
 	lgblock                          int
 	size_hint                        uint
 	disable_literal_context_modeling bool
+	search_distance_params           bool
 	large_window                     bool
 	hasher                           hasherParams
 	dist                             distanceParams
 	dictionary                       encoderDictionary
+
+	/* Position that backward references may not reach before, which is set
+	   after a full flush. */
+	restart uint
 }
@@ -64,6 +64,9 @@ func maxZopfliCandidates(params *encoderParams) uint {
 
 func sanitizeParams(params *encoderParams) {
 	params.quality = brotli_min_int(maxQuality, brotli_max_int(minQuality, params.quality))
+	if params.mode < modeGeneric || params.mode > modeAuto {
+		params.mode = modeGeneric
+	}
 	if params.quality <= maxQualityForStaticEntropyCodes {
 		params.large_window = false
 	}
@@ -3,42 +3,231 @@ package brotli
 import (
 	"errors"
 	"io"
+	"strconv"
 )
 
-type decodeError int
+// ErrorCategory classifies the errors reported by DecodeError.
+type ErrorCategory int
 
-func (err decodeError) Error() string {
-	return "brotli: " + string(decoderErrorString(int(err)))
+const (
+	// CategoryFormat means the compressed data is corrupt or uses a
+	// feature that was not enabled, such as large windows.
+	CategoryFormat ErrorCategory = iota + 1
+	// CategoryAllocation means the decoder could not get, or was not
+	// allowed by ReaderOptions to use, the memory or output the stream
+	// needs.
+	CategoryAllocation
+	// CategoryInvalidArguments means the Reader was used or configured
+	// incorrectly, for example without the dictionary the stream needs.
+	CategoryInvalidArguments
+)
+
+// Sentinel errors matching a DecodeError of each category with errors.Is.
+var (
+	ErrFormat           = errors.New("brotli: corrupt input")
+	ErrAllocation       = errors.New("brotli: resource limit")
+	ErrInvalidArguments = errors.New("brotli: invalid arguments")
+)
+
+// A DecodeError is returned by a Reader when decoding fails.
+type DecodeError struct {
+	// Code is the error code of the reference decoder
+	// (BrotliDecoderErrorCode), always negative.
+	Code     int
+	Category ErrorCategory
+	// Offset is the number of compressed bytes consumed when decoding
+	// failed.
+	Offset int64
+	// Err, if not nil, is a more specific error such as ErrLargeWindow,
+	// ErrOutputLimit or a *MemoryLimitError.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	var msg string = "brotli: " + decoderErrorString(e.Code)
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	return msg + " at offset " + strconv.FormatInt(e.Offset, 10)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error for e's category.
+func (e *DecodeError) Is(target error) bool {
+	switch target {
+	case ErrFormat:
+		return e.Category == CategoryFormat
+	case ErrAllocation:
+		return e.Category == CategoryAllocation
+	case ErrInvalidArguments:
+		return e.Category == CategoryInvalidArguments
+	}
+	return false
+}
+
+func errorCategory(code int) ErrorCategory {
+	switch {
+	case code == decoderErrorDictionaryNotSet || code == decoderErrorInvalidArguments:
+		return CategoryInvalidArguments
+	case code <= decoderErrorAllocContextModes && code >= decoderErrorAllocBlockTypeTrees:
+		return CategoryAllocation
+	}
+	return CategoryFormat
+}
+
+/* Returns the error for decoder error |code|, positioned at the compressed
+   input consumed so far. */
+func (r *Reader) decodeError(code int) error {
+	err := &DecodeError{Code: code, Category: errorCategory(code), Offset: r.InputOffset()}
+	switch code {
+	case decoderErrorFormatLargeWindow:
+		err.Err = ErrLargeWindow
+	case decoderErrorAllocMemoryLimit:
+		err.Err = &MemoryLimitError{Needed: r.memory_needed, Limit: r.memory_limit}
+	case decoderErrorOutputLimit:
+		err.Err = ErrOutputLimit
+	}
+	return err
 }
 
 var errExcessiveInput = errors.New("brotli: excessive input")
 var errInvalidState = errors.New("brotli: invalid state")
 
+// ErrLargeWindow is wrapped by the DecodeError returned when a Reader
+// encounters a "Large Window Brotli" stream without ReaderOptions.LargeWindow
+// set.
+var ErrLargeWindow = errors.New("brotli: large window stream not allowed")
+
+// ErrOutputLimit is wrapped by the DecodeError returned when a Reader
+// reaches ReaderOptions.MaxOutput or MaxRatio.
+var ErrOutputLimit = errors.New("brotli: output limit exceeded")
+
+// ReaderOptions configures Reader.
+type ReaderOptions struct {
+	// LargeWindow allows decoding "Large Window Brotli" streams, which may
+	// use a window of up to 1 GiB. These are produced by a Writer with
+	// WriterOptions.LargeWindow set.
+	LargeWindow bool
+	// Metadata, if not nil, is called with the payload of each non-empty
+	// metadata block in the stream, in stream order, along with the number of
+	// decompressed bytes that precede the block; with Multistream, that
+	// includes the output of earlier streams. The payload is only valid
+	// during the call.
+	Metadata func(offset int64, data []byte)
+	// Dictionary is a raw prefix dictionary: data that is treated as if it had
+	// been decoded just before the start of the stream, without being output.
+	// It must be the same as the WriterOptions.Dictionary used to compress the
+	// stream. Only the last window-size minus 16 bytes are used.
+	Dictionary []byte
+	// SharedDictionary, if not nil, is a Shared Brotli dictionary. It must be
+	// the same as the WriterOptions.SharedDictionary used to compress the
+	// stream. Its prefix may not be combined with Dictionary.
+	SharedDictionary *SharedDictionary
+	// MaxWindow, if positive, is the largest window size in bytes a stream
+	// may declare in its header. Streams with a larger window fail with a
+	// *MemoryLimitError before anything is allocated for them.
+	MaxWindow int
+	// MaxMemory, if positive, limits the memory in bytes the decoder
+	// allocates for a metablock: the ring buffer, which also holds any
+	// prefix dictionary, Huffman tables and context maps, and with a
+	// Metadata callback, the payload of a metadata block. A metablock that
+	// needs more fails with a *MemoryLimitError before these are allocated.
+	MaxMemory int64
+	// MaxOutput, if positive, is the most decompressed bytes Read returns in
+	// total. A stream that decodes to more fails with ErrOutputLimit.
+	MaxOutput int64
+	// MaxRatio, if positive, is the most decompressed bytes the Reader
+	// produces per compressed byte decoded so far. Going over it fails with
+	// ErrOutputLimit. As it applies to every prefix of the stream, a stream
+	// whose start is much more compressed than the rest can fail even if
+	// its overall ratio is lower. Both limits are checked between commands
+	// and at least once per window of output.
+	MaxRatio int
+	// Multistream makes the Reader decode a sequence of concatenated
+	// streams as one, like gzip.Reader.Multistream. Without it, data after
+	// the end of the first stream is an error.
+	Multistream bool
+	// Salvage makes the Reader recover what it can from a damaged or
+	// truncated stream. Instead of failing, Read returns the output decoded
+	// up to the end of the last complete command, then a *SalvageError that
+	// tells where the damage is.
+	Salvage bool
+	// Resync, with Salvage, makes the Reader look for a later metablock that
+	// starts on a byte boundary, as those after uncompressed and metadata
+	// blocks and Writer.Flush do, and resume decoding there. Data before it
+	// is unknown, so back-references into it produce zeros. Damage recovered
+	// from this way is reported by Damage rather than by Read. To search
+	// the input, the Reader reads all the rest of it into memory.
+	Resync bool
+}
+
+// A StreamBoundary is the position of the end of a stream.
+type StreamBoundary struct {
+	CompressedOffset   int64 // compressed bytes up to the end of the stream
+	DecompressedOffset int64 // decompressed bytes up to the end of the stream
+}
+
+// MemoryLimitError is wrapped by the DecodeError returned when a stream needs
+// a larger window or more memory than ReaderOptions.MaxWindow or MaxMemory
+// allow.
+type MemoryLimitError struct {
+	Needed int64 // bytes the stream needs
+	Limit  int64 // the limit that was exceeded
+}
+
+func (e *MemoryLimitError) Error() string {
+	return "brotli: stream needs " + strconv.FormatInt(e.Needed, 10) + " bytes, over the limit of " + strconv.FormatInt(e.Limit, 10)
+}
+
 // readBufSize is a "good" buffer size that avoids excessive round-trips
 // between C and Go but doesn't waste too much memory on buffering.
 // It is arbitrarily chosen to be equal to the constant used in io.Copy.
 const readBufSize = 32 * 1024
 
 // NewReader creates a new Reader reading the given reader.
+//
+// If src implements io.ByteReader, the Reader reads no data from it past
+// the end of the brotli stream, so that the data following the stream can
+// be read from src afterwards.
 func NewReader(src io.Reader) *Reader {
+	return NewReaderOptions(src, ReaderOptions{})
+}
+
+// NewReaderOptions is like NewReader but specifies ReaderOptions.
+func NewReaderOptions(src io.Reader, options ReaderOptions) *Reader {
 	r := new(Reader)
+	r.options = options
 	r.Reset(src)
 	return r
 }
 
 // Reset discards the Reader's state and makes it equivalent to the result of
-// its original state from NewReader, but reading from src instead.
+// its original state from NewReader or NewReaderOptions, but reading from src
+// instead.
 // This permits reusing a Reader rather than allocating a new one.
 // Error is always nil
 func (r *Reader) Reset(src io.Reader) error {
 	if r.error_code < 0 {
 		// There was an unrecoverable error, leaving the Reader's state
 		// undefined. Clear out everything but the buffer.
-		*r = Reader{buf: r.buf}
+		*r = Reader{buf: r.buf, options: r.options}
 	}
 
 	decoderStateInit(r)
+	r.large_window = r.options.LargeWindow
+	r.total_in = 0
+	r.total_out = 0
+	r.stream_start = 0
+	r.stream_ended = false
+	r.boundaries = nil
+	r.salvaging = false
+	r.salvage_err = nil
+	r.damage = nil
 	r.src = src
+	_, r.exact = src.(io.ByteReader)
 	if r.buf == nil {
 		r.buf = make([]byte, readBufSize)
 	}
@@ -46,39 +235,234 @@ func (r *Reader) Reset(src io.Reader) error {
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
-	if !decoderHasMoreOutput(r) && len(r.in) == 0 {
-		m, readErr := r.src.Read(r.buf)
+	n, err = r.read(p)
+	r.total_out += int64(n)
+	return n, err
+}
+
+// InputOffset returns the number of compressed bytes consumed since the
+// last Reset. If src implements io.ByteReader, the Reader reads no further
+// from it than that, so that once Read returns io.EOF the rest of src
+// follows the end of the stream.
+func (r *Reader) InputOffset() int64 {
+	return r.total_in - int64(len(r.in))
+}
+
+// OutputOffset returns the number of decompressed bytes returned by Read
+// since the last Reset. After Read fails with ErrOutputLimit, it is the
+// number of bytes produced before the Reader stopped.
+func (r *Reader) OutputOffset() int64 {
+	return r.total_out
+}
+
+// StreamBoundaries returns the end of each stream decoded so far since the
+// last Reset. With ReaderOptions.Multistream, the end of one stream is the
+// start of the next.
+func (r *Reader) StreamBoundaries() []StreamBoundary {
+	return r.boundaries
+}
+
+/* Records the end of the stream once the decoder has finished it. */
+func (r *Reader) endStream() {
+	if r.stream_ended {
+		return
+	}
+	r.stream_ended = true
+	r.boundaries = append(r.boundaries, StreamBoundary{
+		CompressedOffset:   r.InputOffset(),
+		DecompressedOffset: r.stream_start + decodedSize(r),
+	})
+	if !r.options.Multistream {
+		r.unread()
+	}
+}
+
+/* Resets the decoder for the stream after the one that has just ended. */
+func (r *Reader) nextStream() {
+	r.stream_start = r.boundaries[len(r.boundaries)-1].DecompressedOffset
+	r.stream_ended = false
+	decoderStateInit(r)
+	r.large_window = r.options.LargeWindow
+}
+
+// WriteTo implements io.WriterTo. It decompresses the rest of the stream
+// into w, writing decoded data straight from the decoder's ring buffer
+// rather than through an intermediate buffer.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	if r.salvage_err != nil {
+		return 0, r.salvage_err
+	}
+	done := false
+	for {
+		for decoderHasMoreOutput(r) {
+			var size uint
+			if max := r.options.MaxOutput; max > 0 {
+				if r.total_out >= max {
+					return n, r.decodeError(decoderErrorOutputLimit)
+				}
+				size = uint(max - r.total_out)
+			}
+			out := decoderTakeOutput(r, size)
+			m, err := w.Write(out)
+			n += int64(m)
+			r.total_out += int64(m)
+			if err != nil {
+				return n, err
+			}
+			if m < len(out) {
+				return n, io.ErrShortWrite
+			}
+		}
+
+		if done {
+			// Without Multistream, look for trailing data as Read would,
+			// unless that means reading past the end of the stream.
+			if len(r.in) == 0 && (r.options.Multistream || !r.exact) {
+				m, readErr := r.fill()
+				if m == 0 && readErr != nil {
+					if readErr == io.EOF {
+						return n, nil
+					}
+					return n, readErr
+				}
+			}
+			if len(r.in) == 0 {
+				if r.options.Multistream {
+					continue
+				}
+				return n, nil
+			}
+			if !r.options.Multistream {
+				return n, errExcessiveInput
+			}
+			r.nextStream()
+			done = false
+		}
+
+		// Decode with no room for output, so that it stays in the ring buffer.
+		var out []byte
+		var out_remaining uint
+		in_len := len(r.in)
+		in_remaining := uint(in_len)
+		result := decoderDecompressStream(r, &in_remaining, &r.in, &out_remaining, &out)
+		r.discard(in_len - len(r.in))
+		switch result {
+		case decoderResultSuccess:
+			if r.salvaging {
+				if err := r.finishSalvage(); err != nil {
+					return n, err
+				}
+				break
+			}
+			r.endStream()
+			done = true
+		case decoderResultError:
+			if err := r.fail(r.decodeError(decoderGetErrorCode(r))); err != nil {
+				return n, err
+			}
+		case decoderResultNeedsMoreOutput:
+		case decoderResultNeedsMoreInput:
+			if len(r.in) != 0 {
+				return n, errInvalidState
+			}
+			m, readErr := r.fill()
+			if m == 0 {
+				if readErr == io.EOF {
+					if err := r.fail(io.ErrUnexpectedEOF); err != nil {
+						return n, err
+					}
+				} else if readErr != nil {
+					return n, readErr
+				}
+			}
+		}
+	}
+}
+
+func (r *Reader) read(p []byte) (n int, err error) {
+	if r.salvage_err != nil {
+		return 0, r.salvage_err
+	}
+	if !decoderHasMoreOutput(r) && len(r.in) == 0 && !r.salvaging {
+		if r.exact && r.state == stateDone && !r.options.Multistream {
+			// Don't read past the end of the stream.
+			return 0, io.EOF
+		}
+		m, readErr := r.fill()
 		if m == 0 {
 			// If readErr is `nil`, we just proxy underlying stream behavior.
-			return 0, readErr
+			if readErr == io.EOF && r.state != stateDone {
+				// The stream is truncated.
+				if err := r.fail(io.ErrUnexpectedEOF); err != nil {
+					return 0, err
+				}
+			} else {
+				return 0, readErr
+			}
 		}
-		r.in = r.buf[:m]
 	}
 
 	if len(p) == 0 {
 		return 0, nil
 	}
 
+	// Never return more than MaxOutput bytes. Once they have been returned,
+	// decoding on with no room for output tells whether the stream ends there.
+	outputLimited := false
+	if max := r.options.MaxOutput; max > 0 && int64(len(p)) >= max-r.total_out {
+		p = p[:max-r.total_out]
+		outputLimited = true
+	}
+
 	for {
+		if r.options.Multistream && r.stream_ended && len(r.in) > 0 {
+			r.nextStream()
+		}
+
 		var written uint
 		in_len := uint(len(r.in))
 		out_len := uint(len(p))
 		in_remaining := in_len
 		out_remaining := out_len
 		result := decoderDecompressStream(r, &in_remaining, &r.in, &out_remaining, &p)
+		r.discard(int(in_len) - len(r.in))
 		written = out_len - out_remaining
 		n = int(written)
 
 		switch result {
 		case decoderResultSuccess:
+			if r.salvaging {
+				if err := r.finishSalvage(); err != nil {
+					return n, err
+				}
+				if n == 0 {
+					continue
+				}
+				return n, nil
+			}
+			r.endStream()
 			if len(r.in) > 0 {
-				return n, errExcessiveInput
+				if !r.options.Multistream {
+					return n, errExcessiveInput
+				}
+				if n == 0 {
+					continue
+				}
 			}
 			return n, nil
 		case decoderResultError:
-			return n, decodeError(decoderGetErrorCode(r))
+			if err := r.fail(r.decodeError(decoderGetErrorCode(r))); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
 		case decoderResultNeedsMoreOutput:
 			if n == 0 {
+				if outputLimited {
+					return 0, r.decodeError(decoderErrorOutputLimit)
+				}
 				return 0, io.ErrShortBuffer
 			}
 			return n, nil
@@ -95,14 +479,83 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 		}
 
 		// Top off the buffer.
-		encN, err := r.src.Read(r.buf)
+		encN, err := r.fill()
 		if encN == 0 {
 			// Not enough data to complete decoding.
 			if err == io.EOF {
-				return 0, io.ErrUnexpectedEOF
+				if err := r.fail(io.ErrUnexpectedEOF); err != nil {
+					return 0, err
+				}
+				continue
 			}
 			return 0, err
 		}
-		r.in = r.buf[:encN]
 	}
 }
+
+// peekReader is implemented by sources such as bufio.Reader whose buffered
+// data the Reader can decode in place, consuming only what it uses.
+type peekReader interface {
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Buffered() int
+}
+
+/* Reads more compressed input into r.in, which must be empty, and returns
+   the number of bytes read. When src is an io.ByteReader nothing is read
+   from it that the decoder does not consume: a peekReader's buffer is only
+   peeked at until then, an io.Seeker is read ahead and seeked back by
+   unread, and other sources are read one byte at a time. */
+func (r *Reader) fill() (int, error) {
+	var m int
+	var err error
+	if !r.exact {
+		m, err = r.src.Read(r.buf)
+		r.in = r.buf[:m]
+	} else if src, ok := r.src.(peekReader); ok {
+		if _, err = src.Peek(1); err == nil {
+			r.in, err = src.Peek(src.Buffered())
+		} else {
+			r.in = nil
+		}
+		m = len(r.in)
+	} else if _, ok := r.src.(io.Seeker); ok {
+		m, err = r.src.Read(r.buf)
+		r.in = r.buf[:m]
+	} else {
+		var c byte
+		if c, err = r.src.(io.ByteReader).ReadByte(); err == nil {
+			r.buf[0] = c
+			m = 1
+		}
+		r.in = r.buf[:m]
+	}
+	r.total_in += int64(m)
+	return m, err
+}
+
+/* Consumes the |n| bytes the decoder took from the front of r.in from a
+   peekReader source. */
+func (r *Reader) discard(n int) {
+	if src, ok := r.src.(peekReader); ok && r.exact && n > 0 {
+		src.Discard(n)
+	}
+}
+
+/* Gives the input left over after the end of the stream back to src. */
+func (r *Reader) unread() {
+	if !r.exact || len(r.in) == 0 {
+		return
+	}
+	if _, ok := r.src.(peekReader); !ok {
+		src, ok := r.src.(io.Seeker)
+		if !ok {
+			return
+		}
+		if _, err := src.Seek(-int64(len(r.in)), io.SeekCurrent); err != nil {
+			return
+		}
+	}
+	r.total_in -= int64(len(r.in))
+	r.in = nil
+}
@@ -120,15 +120,62 @@ func ringBufferWrite(bytes []byte, n uint, rb *ringBuffer) {
 			copy(rb.buffer_, bytes[rb.size_-uint32(masked_pos):][:uint32(n)-(rb.size_-uint32(masked_pos))])
 		}
 	}
-	{
-		var not_first_lap bool = rb.pos_&(1<<31) != 0
-		var rb_pos_mask uint32 = (1 << 31) - 1
-		rb.data_[0] = rb.buffer_[rb.size_-2]
-		rb.data_[1] = rb.buffer_[rb.size_-1]
-		rb.pos_ = (rb.pos_ & rb_pos_mask) + uint32(uint32(n)&rb_pos_mask)
-		if not_first_lap {
-			/* Wrap, but preserve not-a-first-lap feature. */
-			rb.pos_ |= 1 << 31
-		}
+	ringBufferAdvance(n, rb)
+}
+
+/* Moves the position past |n| bytes written at it, and updates the copy
+   of the last two bytes. */
+func ringBufferAdvance(n uint, rb *ringBuffer) {
+	var not_first_lap bool = rb.pos_&(1<<31) != 0
+	var rb_pos_mask uint32 = (1 << 31) - 1
+	rb.data_[0] = rb.buffer_[rb.size_-2]
+	rb.data_[1] = rb.buffer_[rb.size_-1]
+	rb.pos_ = (rb.pos_ & rb_pos_mask) + uint32(uint32(n)&rb_pos_mask)
+	if not_first_lap {
+		/* Wrap, but preserve not-a-first-lap feature. */
+		rb.pos_ |= 1 << 31
+	}
+}
+
+/* Returns the space for up to |n| more bytes at the current position, for
+   the caller to fill in place of the bytes ringBufferWrite would copy, and
+   then to pass to ringBufferCommit. The space does not wrap around the end
+   of the buffer, so it may be shorter than |n|.
+   As with ringBufferWrite, a first block shorter than the tail gets only
+   as much memory as it needs, and it may be filled a part at a time. */
+func ringBufferSpace(n uint, rb *ringBuffer) []byte {
+	if rb.pos_ == 0 && uint32(n) < rb.tail_size_ {
+		ringBufferInitBuffer(uint32(n), rb)
+		return rb.buffer_[:n]
+	}
+
+	if rb.cur_size_ < rb.tail_size_ && rb.pos_ < rb.cur_size_ {
+		return rb.buffer_[rb.pos_:][:brotli_min_size_t(n, uint(rb.cur_size_-rb.pos_))]
 	}
+
+	if rb.cur_size_ < rb.total_size_ {
+		/* Lazily allocate the full buffer. */
+		ringBufferInitBuffer(rb.total_size_, rb)
+
+		rb.buffer_[rb.size_-2] = 0
+
+		rb.buffer_[rb.size_-1] = 0
+	}
+
+	var masked_pos uint = uint(rb.pos_ & rb.mask_)
+	return rb.buffer_[masked_pos:][:brotli_min_size_t(n, uint(rb.size_)-masked_pos)]
+}
+
+/* Pushes the |n| bytes that the caller has put at the start of the space
+   returned by ringBufferSpace into the ring buffer. */
+func ringBufferCommit(n uint, rb *ringBuffer) {
+	if rb.cur_size_ < rb.tail_size_ {
+		/* The first block is not in the tail, as in ringBufferWrite. */
+		rb.pos_ += uint32(n)
+		return
+	}
+
+	var masked_pos uint = uint(rb.pos_ & rb.mask_)
+	ringBufferWriteTail(rb.buffer_[masked_pos:], n, rb)
+	ringBufferAdvance(n, rb)
 }
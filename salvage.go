@@ -0,0 +1,228 @@
+package brotli
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// A SalvageError describes damage in a stream read by a Reader with
+// ReaderOptions.Salvage set.
+type SalvageError struct {
+	// CompressedOffset is the number of compressed bytes consumed when the
+	// damage was detected.
+	CompressedOffset int64
+	// DecompressedOffset is the number of decompressed bytes before the
+	// damage: the output up to the end of the last command that was decoded
+	// in full.
+	DecompressedOffset int64
+	// ResumeOffset is the compressed offset of the metablock at which
+	// decoding resumed with ReaderOptions.Resync, or -1 if it did not.
+	ResumeOffset int64
+	// Err is the error that the damage caused: a *DecodeError or
+	// io.ErrUnexpectedEOF.
+	Err error
+}
+
+func (e *SalvageError) Error() string {
+	return "brotli: damaged stream at offset " + strconv.FormatInt(e.CompressedOffset, 10) +
+		" (decompressed offset " + strconv.FormatInt(e.DecompressedOffset, 10) + "): " + e.Err.Error()
+}
+
+func (e *SalvageError) Unwrap() error {
+	return e.Err
+}
+
+// Damage returns the damage a Reader with ReaderOptions.Salvage set has
+// recovered from since the last Reset, in stream order.
+func (r *Reader) Damage() []*SalvageError {
+	return r.damage
+}
+
+/* Handles a decoding failure. Without ReaderOptions.Salvage, or if |err| is
+   not caused by damaged input, it returns |err|. Otherwise it records the
+   damage, makes the decoder hand out what was decoded up to the last
+   complete command as if the stream ended there, and returns nil; once that
+   output is out the decoder reports success and the caller calls
+   finishSalvage. */
+func (r *Reader) fail(err error) error {
+	if !r.options.Salvage {
+		return err
+	}
+	var derr *DecodeError
+	if err != io.ErrUnexpectedEOF && !(errors.As(err, &derr) && derr.Category == CategoryFormat) {
+		return err
+	}
+
+	/* Output up to partial_pos_out has been handed out already. */
+	var pos int64 = r.salvage_pos
+	if pos < int64(r.partial_pos_out) {
+		pos = int64(r.partial_pos_out)
+	}
+	if r.state == stateUninited || r.state == stateLargeWindowBits {
+		/* No window to resume with. */
+		r.window_bits = 0
+	}
+	r.damage = append(r.damage, &SalvageError{
+		CompressedOffset:   r.InputOffset(),
+		DecompressedOffset: r.stream_start + pos - int64(r.custom_dict_size),
+		ResumeOffset:       -1,
+		Err:                err,
+	})
+
+	if r.ringbuffer != nil {
+		r.pos = int(pos - int64(r.rb_roundtrips)*int64(r.ringbuffer_size))
+	}
+	r.error_code = decoderSuccess
+	r.buffer_length = 0
+	r.meta_block_remaining_len = 0
+	r.state = stateDone
+	r.salvaging = true
+	return nil
+}
+
+/* Called when the output before the damage has been handed out. Without
+   ReaderOptions.Resync, or if no later metablock can be found, it ends
+   decoding with the SalvageError. Otherwise the decoder continues with the
+   metablock found, and finishSalvage returns nil. */
+func (r *Reader) finishSalvage() error {
+	r.salvaging = false
+	var damage *SalvageError = r.damage[len(r.damage)-1]
+	if r.options.Resync && r.window_bits != 0 {
+		/* Bytes peeked from src are still in it, and in a buffer it reuses,
+		   so they are copied and then consumed before reading the rest. */
+		var rest []byte = append([]byte(nil), r.in...)
+		r.discard(len(r.in))
+		more, err := io.ReadAll(r.src)
+		r.total_in += int64(len(more))
+		rest = append(rest, more...)
+		if err != nil {
+			r.in = rest
+			return err
+		}
+
+		for p := 0; p < len(rest); p++ {
+			if resyncCandidate(r, rest[p:]) {
+				r.in = rest[p:]
+				damage.ResumeOffset = r.InputOffset()
+				var window_bits uint32 = r.window_bits
+				var large_window bool = r.large_window
+				decoderStateInit(r)
+				decoderStateResync(r, window_bits, large_window)
+				r.stream_start = damage.DecompressedOffset
+				r.stream_ended = false
+				return nil
+			}
+		}
+		r.in = nil
+	}
+	r.salvage_err = damage
+	return damage
+}
+
+/* Values of Reader.unknown_history. */
+const (
+	historyKnown = iota
+	historyUnknownZero
+	historyUnknownAny
+)
+
+/* Prepares a fresh decoder state to start at a metablock in the middle of a
+   stream with the given window. The history before that metablock is
+   unknown; back-references into it copy zeros. */
+func decoderStateResync(s *Reader, window_bits uint32, large_window bool) {
+	s.window_bits = window_bits
+	s.large_window = large_window
+	s.unknown_history = historyUnknownZero
+	s.state = stateInitialize
+}
+
+/* Fills the window with unknown history, so that decoding can go on as if
+   the stream had started much earlier. Unless |fill| is set, the history is
+   whatever the ring buffer holds. */
+func decoderPrependUnknownHistory(s *Reader, fill bool) {
+	var size int = s.max_backward_distance
+	s.new_ringbuffer_size = 1 << s.window_bits
+	ensureRingBuffer(s)
+	if fill {
+		clear(s.ringbuffer[:size])
+	}
+	s.pos = size
+	s.partial_pos_out = uint(size)
+	s.custom_dict_size = size
+	s.salvage_pos = int64(size)
+}
+
+/* Bounds on the work of trying one place to resume at, so that searching
+   damaged input takes time linear in its size. */
+const (
+	resyncTrialInput  = 1 << 16
+	resyncTrialOutput = 1 << 20
+)
+
+/* Reports whether |data| plausibly starts with a metablock of the stream
+   |r| is decoding: decoding from there must complete two metablocks, one of
+   them with output, or reach the end of the stream at the end of |data|.
+   Decoding that goes on without error past the bounds above, or up to the
+   limits of |r|, is plausible too; the limits are left for the Reader to
+   report. */
+func resyncCandidate(r *Reader, data []byte) bool {
+	/* The trial decoder is kept to reuse its ring buffer. */
+	if r.resync_trial == nil {
+		r.resync_trial = &Reader{}
+	}
+	var s *Reader = r.resync_trial
+	s.options = ReaderOptions{
+		SharedDictionary: r.options.SharedDictionary,
+		MaxMemory:        r.options.MaxMemory,
+		MaxOutput:        resyncTrialOutput,
+		MaxRatio:         r.options.MaxRatio,
+	}
+	if max := r.options.MaxOutput; max > 0 && max < s.options.MaxOutput {
+		s.options.MaxOutput = max
+	}
+	decoderStateInit(s)
+	decoderStateResync(s, r.window_bits, r.large_window)
+	s.unknown_history = historyUnknownAny
+	in := &inspector{}
+	s.inspector = in
+
+	var limited bool = len(data) > resyncTrialInput
+	if limited {
+		data = data[:resyncTrialInput]
+	}
+	/* As if a Reader had read |data|, so that the ratio and the metablock
+	   offsets are counted as usual. */
+	s.in = data
+	s.total_in = int64(len(data))
+	var available_in uint = uint(len(data))
+	for {
+		var out []byte
+		var available_out uint
+		var result int = decoderDecompressStream(s, &available_in, &s.in, &available_out, &out)
+		if result == decoderResultSuccess {
+			return available_in == 0 && !limited
+		}
+
+		var complete int
+		var output bool
+		for _, m := range in.metablocks {
+			if m.CompressedBits != 0 {
+				complete++
+				output = output || (!m.Metadata && m.UncompressedSize > 0)
+			}
+		}
+		if complete >= 2 && output {
+			return true
+		}
+
+		switch result {
+		case decoderResultNeedsMoreInput:
+			return limited
+		case decoderResultError:
+			var code int = decoderGetErrorCode(s)
+			return code == decoderErrorOutputLimit || code == decoderErrorAllocMemoryLimit
+		}
+		decoderTakeOutput(s, 0)
+	}
+}
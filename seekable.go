@@ -0,0 +1,352 @@
+package brotli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+/* Seekable format
+
+   The data is cut into chunks that are compressed as separate brotli
+   streams and concatenated, so that a Reader with Multistream set decodes
+   the whole. They are followed by one more stream that holds the index in a
+   metadata block, and decodes to nothing:
+
+     varint   number of chunks
+     for each chunk:
+       varint compressed size
+       varint uncompressed size
+     uint32   size of the index stream, little-endian
+     4 bytes  seekableMagic
+
+   The index stream ends with the empty last metablock, which after the byte
+   aligned metadata is the single byte 0x03, so the index can be found from
+   the end of the data. */
+
+var seekableMagic = [4]byte{'B', 'R', 'S', 'K'}
+
+/* The index stream ends with the magic, its size and the last metablock. */
+const seekableFooterSize = 4 + len(seekableMagic) + 1
+
+// ErrNotSeekable is returned by NewSeekableReader if the data does not end
+// with a valid seekable index, and by SeekableReader reads if a chunk does
+// not decode to the size the index records for it.
+var ErrNotSeekable = errors.New("brotli: not a seekable stream")
+
+var errSeekableChunkSize = errors.New("brotli: chunk size must be positive")
+
+type seekableChunk struct {
+	compressed_offset   int64
+	compressed_size     int64
+	uncompressed_offset int64
+	uncompressed_size   int64
+}
+
+// A SeekableWriter compresses data in the seekable format: independently
+// decodable chunks followed by an index that lets a SeekableReader decode
+// any part of the data without decoding what comes before it. The output
+// is a series of concatenated brotli streams, which any Reader with
+// ReaderOptions.Multistream set decodes to the original data.
+type SeekableWriter struct {
+	dst        countingWriter
+	w          *Writer
+	chunk_size int
+	buffered   int
+	started    bool
+	chunks     []seekableChunk
+	err        error
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewSeekableWriter returns a SeekableWriter that compresses to dst with
+// the given options, starting a new chunk every chunkSize bytes of input.
+// Smaller chunks make random access cheaper and compression worse.
+// It is the caller's responsibility to call Close on the SeekableWriter
+// when done; the index is only written then.
+func NewSeekableWriter(dst io.Writer, options WriterOptions, chunkSize int) *SeekableWriter {
+	w := &SeekableWriter{chunk_size: chunkSize}
+	w.dst.w = dst
+	w.w = NewWriterOptions(&w.dst, options)
+	if chunkSize <= 0 {
+		w.err = errSeekableChunkSize
+	}
+	return w
+}
+
+// Write implements io.Writer.
+func (w *SeekableWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && w.err == nil {
+		if !w.started {
+			w.w.Reset(&w.dst)
+			w.started = true
+			w.chunks = append(w.chunks, seekableChunk{compressed_offset: w.dst.n})
+		}
+		var m int = w.chunk_size - w.buffered
+		if m > len(p) {
+			m = len(p)
+		}
+		m, w.err = w.w.Write(p[:m])
+		n += m
+		w.buffered += m
+		p = p[m:]
+		if w.buffered == w.chunk_size {
+			w.endChunk()
+		}
+	}
+	return n, w.err
+}
+
+// Flush ends the current chunk, so that everything written so far can be
+// decoded. The next Write starts a new chunk.
+func (w *SeekableWriter) Flush() error {
+	if w.started && w.err == nil {
+		w.endChunk()
+	}
+	return w.err
+}
+
+/* Finishes the stream of the current chunk and records it in the index. */
+func (w *SeekableWriter) endChunk() {
+	w.err = w.w.Close()
+	var c *seekableChunk = &w.chunks[len(w.chunks)-1]
+	c.compressed_size = w.dst.n - c.compressed_offset
+	c.uncompressed_size = int64(w.buffered)
+	w.buffered = 0
+	w.started = false
+}
+
+// Close ends the last chunk and writes the index.
+func (w *SeekableWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.started {
+		w.endChunk()
+		if w.err != nil {
+			return w.err
+		}
+	}
+
+	var index []byte = binary.AppendUvarint(nil, uint64(len(w.chunks)))
+	for _, c := range w.chunks {
+		index = binary.AppendUvarint(index, uint64(c.compressed_size))
+		index = binary.AppendUvarint(index, uint64(c.uncompressed_size))
+	}
+
+	index = binary.LittleEndian.AppendUint32(index, 0)
+	index = append(index, seekableMagic[:]...)
+
+	/* Metadata is stored as is, so the size can be filled in afterwards. */
+	var buf bytes.Buffer
+	iw := NewWriterOptions(&buf, WriterOptions{Quality: BestSpeed})
+	if w.err = iw.WriteMetadata(index); w.err != nil {
+		return w.err
+	}
+	if w.err = iw.Close(); w.err != nil {
+		return w.err
+	}
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[len(out)-seekableFooterSize:], uint32(len(out)))
+	if _, w.err = w.dst.Write(out); w.err != nil {
+		return w.err
+	}
+	w.err = errWriterClosed
+	return nil
+}
+
+// A SeekableReader decompresses data written by a SeekableWriter. It
+// implements io.Reader, io.Seeker and io.ReaderAt; ReadAt may be called
+// concurrently. Decoding starts at the chunk that holds the requested
+// offset, and the most recently decoded chunk is kept for the next read.
+type SeekableReader struct {
+	src     io.ReaderAt
+	options ReaderOptions
+	chunks  []seekableChunk
+	size    int64
+	offset  int64
+
+	mu           sync.Mutex
+	cached       []byte
+	cached_index int
+}
+
+// NewSeekableReader returns a SeekableReader reading seekable data of the
+// given compressed size from src.
+func NewSeekableReader(src io.ReaderAt, size int64) (*SeekableReader, error) {
+	return NewSeekableReaderOptions(src, size, ReaderOptions{})
+}
+
+// NewSeekableReaderOptions is like NewSeekableReader but specifies the
+// ReaderOptions used to decode each chunk. Multistream is ignored.
+func NewSeekableReaderOptions(src io.ReaderAt, size int64, options ReaderOptions) (*SeekableReader, error) {
+	options.Multistream = false
+	r := &SeekableReader{src: src, options: options, cached_index: -1}
+	if err := r.readIndex(size); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/* Finds, decodes and checks the index at the end of the data. */
+func (r *SeekableReader) readIndex(size int64) error {
+	var footer [seekableFooterSize]byte
+	if size < int64(len(footer)) {
+		return ErrNotSeekable
+	}
+	if _, err := r.src.ReadAt(footer[:], size-int64(len(footer))); err != nil {
+		return err
+	}
+	if [4]byte(footer[4:8]) != seekableMagic || footer[8] != 0x03 {
+		return ErrNotSeekable
+	}
+	var index_size int64 = int64(binary.LittleEndian.Uint32(footer[:4]))
+	if index_size > size {
+		return ErrNotSeekable
+	}
+
+	var index []byte
+	d := NewReaderOptions(io.NewSectionReader(r.src, size-index_size, index_size), ReaderOptions{
+		Metadata: func(offset int64, p []byte) {
+			if index == nil {
+				index = append([]byte{}, p...)
+			}
+		},
+	})
+	if n, err := io.Copy(io.Discard, d); err != nil || n != 0 || len(index) < len(footer)-1 {
+		return ErrNotSeekable
+	}
+	index = index[:len(index)-(len(footer)-1)]
+
+	count, n := binary.Uvarint(index)
+	if n <= 0 || count > uint64(len(index)) {
+		return ErrNotSeekable
+	}
+	index = index[n:]
+	r.chunks = make([]seekableChunk, count)
+	var compressed, uncompressed int64
+	for i := range r.chunks {
+		c, n := binary.Uvarint(index)
+		if n <= 0 {
+			return ErrNotSeekable
+		}
+		index = index[n:]
+		u, n := binary.Uvarint(index)
+		if n <= 0 || c == 0 || c > uint64(size) || u > 1<<62 {
+			return ErrNotSeekable
+		}
+		index = index[n:]
+		r.chunks[i] = seekableChunk{compressed, int64(c), uncompressed, int64(u)}
+		compressed += int64(c)
+		uncompressed += int64(u)
+	}
+	if len(index) != 0 || compressed != size-index_size {
+		return ErrNotSeekable
+	}
+	r.size = uncompressed
+	return nil
+}
+
+// Size returns the uncompressed size of the data.
+func (r *SeekableReader) Size() int64 {
+	return r.size
+}
+
+// Read implements io.Reader.
+func (r *SeekableReader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	n, err = r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("brotli: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("brotli: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *SeekableReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("brotli: negative offset")
+	}
+	var i int = sort.Search(len(r.chunks), func(i int) bool {
+		c := &r.chunks[i]
+		return c.uncompressed_offset+c.uncompressed_size > off
+	})
+	for n < len(p) && i < len(r.chunks) {
+		data, err := r.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], data[off+int64(n)-r.chunks[i].uncompressed_offset:])
+		n += m
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+/* Returns the decoded data of chunk |i|. */
+func (r *SeekableReader) chunk(i int) ([]byte, error) {
+	r.mu.Lock()
+	if r.cached_index == i {
+		data := r.cached
+		r.mu.Unlock()
+		return data, nil
+	}
+	r.mu.Unlock()
+
+	/* The index is not trusted with the size of the buffer: the chunk is
+	   decoded as a stream, which is limited by r.options, and must then
+	   come out at the recorded size. */
+	var c *seekableChunk = &r.chunks[i]
+	var buf bytes.Buffer
+	d := NewReaderOptions(io.NewSectionReader(r.src, c.compressed_offset, c.compressed_size), r.options)
+	if _, err := buf.ReadFrom(io.LimitReader(d, c.uncompressed_size+1)); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != c.uncompressed_size {
+		return nil, ErrNotSeekable
+	}
+	data := buf.Bytes()
+
+	r.mu.Lock()
+	r.cached = data
+	r.cached_index = i
+	r.mu.Unlock()
+	return data, nil
+}
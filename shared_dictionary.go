@@ -0,0 +1,513 @@
+package brotli
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+/* Shared Brotli dictionaries.
+
+   A serialized dictionary is laid out as follows (all counts are single
+   bytes unless noted):
+
+     magic            0x91 0x00
+     prefix length    varint (LEB128), followed by the LZ77 prefix
+     NUM_WORD_LISTS   followed by each word list:
+                        28 bytes of size_bits_by_length for lengths 4..31
+                        (0 means no words of that length, at most 15),
+                        then the words, grouped by length
+     NUM_TRANSFORM_LISTS  followed by each transform list:
+                        uint16 (little endian) size of the prefix/suffix
+                        table, then the table as length-prefixed strings,
+                        NUM_TRANSFORMS, then a (prefix id, type, suffix id)
+                        triplet per transform, then, if any transform is a
+                        SHIFT transform, a uint16 parameter per transform
+     NUM_DICTIONARIES followed by a (word list, transform list) index pair
+                      per dictionary; an index equal to the number of lists
+                      selects the RFC 7932 word list or transforms
+     if NUM_DICTIONARIES > 1:
+       CONTEXT_BASED  0 or 1; if 1, followed by 64 bytes mapping each
+                      literal context to a dictionary. Otherwise distances
+                      past the end of one dictionary continue into the next.
+*/
+
+const maxSharedDictionaryWordLength = 31
+
+const sharedDictionaryMaxContexts = 64
+
+/* Longest transformed word: 255 byte prefix, word, 255 byte suffix. */
+const sharedDictionaryWriteAheadSlack = 2*255 + maxSharedDictionaryWordLength
+
+var sharedDictionaryMagic = [2]byte{0x91, 0x00}
+
+var (
+	errSharedDictionaryFormat = errors.New("brotli: invalid shared dictionary")
+	errDictionaryConflict     = errors.New("brotli: both Dictionary and SharedDictionary set a prefix")
+)
+
+// A SharedDictionary is a dictionary in the Shared Brotli format. It may hold
+// an LZ77 prefix (like WriterOptions.Dictionary), custom static dictionary
+// word lists and transforms that replace the RFC 7932 ones, and a context
+// map that selects a word list by the preceding two bytes.
+//
+// The same SharedDictionary must be given to the Writer and the Reader.
+// The Writer only searches the first word list, and none at all if the
+// dictionary is context based; the Reader supports all of them.
+// A SharedDictionary is safe for concurrent use.
+type SharedDictionary struct {
+	prefix          []byte
+	word_lists      []dictionary
+	transform_lists []transforms
+	words           []*dictionary
+	transforms      []*transforms
+	word_index      []byte
+	transform_index []byte
+	context_based   bool
+	context_map     [sharedDictionaryMaxContexts]byte
+
+	encoderOnce sync.Once
+	encoder     encoderDictionary
+}
+
+// NewSharedDictionary returns a SharedDictionary with the given LZ77 prefix
+// and custom word list, used with the RFC 7932 transforms. Either may be
+// empty; a nil word list keeps the RFC 7932 words. Words must be 4 to 31
+// bytes long, with at most 32768 words of each length.
+func NewSharedDictionary(prefix []byte, words [][]byte) (*SharedDictionary, error) {
+	d := &SharedDictionary{prefix: append([]byte(nil), prefix...)}
+	if words != nil {
+		list, err := buildWordList(words)
+		if err != nil {
+			return nil, err
+		}
+		d.word_lists = []dictionary{list}
+	}
+
+	/* Index 0 is either the custom list or, if there is none, the built-in
+	   one. */
+	d.word_index = []byte{0}
+	d.transform_index = []byte{0}
+	if err := d.link(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+/* Groups |words| by length and pads each group to a power of two by
+   repeating its last word. */
+func buildWordList(words [][]byte) (dictionary, error) {
+	var list dictionary
+	var by_length [maxSharedDictionaryWordLength + 1][][]byte
+	for _, w := range words {
+		if len(w) < minDictionaryWordLength || len(w) > maxSharedDictionaryWordLength {
+			return list, errors.New("brotli: dictionary word length out of range")
+		}
+		by_length[len(w)] = append(by_length[len(w)], w)
+	}
+
+	for l := minDictionaryWordLength; l <= maxSharedDictionaryWordLength; l++ {
+		n := len(by_length[l])
+		if n == 0 {
+			continue
+		}
+		if n > 1<<15 {
+			return list, errors.New("brotli: too many dictionary words of one length")
+		}
+		var bits byte
+		for 1<<bits < n {
+			bits++
+		}
+		if bits == 0 {
+			/* A size of 0 bits means no words, so store a single word twice. */
+			bits = 1
+		}
+		list.size_bits_by_length[l] = bits
+	}
+
+	computeDictionaryOffsets(&list)
+	list.data = make([]byte, 0, list.data_size)
+	for l := minDictionaryWordLength; l <= maxSharedDictionaryWordLength; l++ {
+		group := by_length[l]
+		if len(group) == 0 {
+			continue
+		}
+		for i := 0; i < 1<<list.size_bits_by_length[l]; i++ {
+			list.data = append(list.data, group[brotli_min_int(i, len(group)-1)]...)
+		}
+	}
+	return list, nil
+}
+
+func computeDictionaryOffsets(d *dictionary) {
+	var offset uint32
+	for l := 0; l <= maxSharedDictionaryWordLength; l++ {
+		d.offsets_by_length[l] = offset
+		if d.size_bits_by_length[l] != 0 {
+			offset += uint32(l) << d.size_bits_by_length[l]
+		}
+	}
+	d.data_size = uint(offset)
+}
+
+// ParseSharedDictionary parses a serialized Shared Brotli dictionary.
+func ParseSharedDictionary(data []byte) (*SharedDictionary, error) {
+	d := new(SharedDictionary)
+	if err := d.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It must not be
+// called on a SharedDictionary that is in use.
+func (d *SharedDictionary) UnmarshalBinary(data []byte) error {
+	data = append([]byte(nil), data...)
+	*d = SharedDictionary{}
+	p := sharedDictionaryParser{data: data}
+	if p.next() != sharedDictionaryMagic[0] || p.next() != sharedDictionaryMagic[1] {
+		return errSharedDictionaryFormat
+	}
+
+	prefix_size := p.varint()
+	if prefix_size > 1<<30 {
+		return errSharedDictionaryFormat
+	}
+	d.prefix = p.bytes(int(prefix_size))
+
+	num_word_lists := int(p.next())
+	if num_word_lists > sharedDictionaryMaxContexts {
+		return errSharedDictionaryFormat
+	}
+	d.word_lists = make([]dictionary, num_word_lists)
+	for i := range d.word_lists {
+		p.wordList(&d.word_lists[i])
+	}
+
+	num_transform_lists := int(p.next())
+	if num_transform_lists > sharedDictionaryMaxContexts {
+		return errSharedDictionaryFormat
+	}
+	d.transform_lists = make([]transforms, num_transform_lists)
+	for i := range d.transform_lists {
+		p.transformList(&d.transform_lists[i])
+	}
+
+	num_dictionaries := int(p.next())
+	if num_dictionaries == 0 || num_dictionaries > sharedDictionaryMaxContexts {
+		return errSharedDictionaryFormat
+	}
+	d.word_index = make([]byte, num_dictionaries)
+	d.transform_index = make([]byte, num_dictionaries)
+	for i := 0; i < num_dictionaries; i++ {
+		d.word_index[i] = p.next()
+		d.transform_index[i] = p.next()
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if err := d.link(); err != nil {
+		return err
+	}
+
+	if num_dictionaries > 1 {
+		switch p.next() {
+		case 0:
+		case 1:
+			d.context_based = true
+			copy(d.context_map[:], p.bytes(sharedDictionaryMaxContexts))
+			for _, id := range d.context_map {
+				if int(id) >= num_dictionaries {
+					return errSharedDictionaryFormat
+				}
+			}
+		default:
+			return errSharedDictionaryFormat
+		}
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+	if p.pos != len(data) {
+		return errSharedDictionaryFormat
+	}
+	return nil
+}
+
+/* Resolves the word and transform list indices of each dictionary. */
+func (d *SharedDictionary) link() error {
+	d.words = make([]*dictionary, len(d.word_index))
+	d.transforms = make([]*transforms, len(d.transform_index))
+	for i := range d.word_index {
+		switch w := int(d.word_index[i]); {
+		case w < len(d.word_lists):
+			d.words[i] = &d.word_lists[w]
+		case w == len(d.word_lists):
+			d.words[i] = getDictionary()
+		default:
+			return errSharedDictionaryFormat
+		}
+		switch t := int(d.transform_index[i]); {
+		case t < len(d.transform_lists):
+			d.transforms[i] = &d.transform_lists[t]
+		case t == len(d.transform_lists):
+			d.transforms[i] = getTransforms()
+		default:
+			return errSharedDictionaryFormat
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The result can be
+// parsed by ParseSharedDictionary.
+func (d *SharedDictionary) MarshalBinary() ([]byte, error) {
+	out := append([]byte(nil), sharedDictionaryMagic[:]...)
+	out = binary.AppendUvarint(out, uint64(len(d.prefix)))
+	out = append(out, d.prefix...)
+
+	out = append(out, byte(len(d.word_lists)))
+	for i := range d.word_lists {
+		w := &d.word_lists[i]
+		out = append(out, w.size_bits_by_length[minDictionaryWordLength:]...)
+		out = append(out, w.data[:w.data_size]...)
+	}
+
+	out = append(out, byte(len(d.transform_lists)))
+	for i := range d.transform_lists {
+		t := &d.transform_lists[i]
+		out = binary.LittleEndian.AppendUint16(out, t.prefix_suffix_size)
+		out = append(out, t.prefix_suffix[:t.prefix_suffix_size]...)
+		out = append(out, byte(t.num_transforms))
+		out = append(out, t.transforms[:3*t.num_transforms]...)
+		if t.params != nil {
+			out = append(out, t.params[:2*t.num_transforms]...)
+		}
+	}
+
+	out = append(out, byte(len(d.words)))
+	for i := range d.words {
+		out = append(out, d.word_index[i], d.transform_index[i])
+	}
+	if len(d.words) > 1 {
+		if d.context_based {
+			out = append(out, 1)
+			out = append(out, d.context_map[:]...)
+		} else {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
+
+/* Returns the dictionary the Writer searches, building its hash tables on
+   first use. */
+func (d *SharedDictionary) encoderDictionary() *encoderDictionary {
+	d.encoderOnce.Do(func() {
+		if d.context_based {
+			/* The encoder does not track literal contexts while matching. */
+			d.encoder = encoderDictionary{
+				words:      getDictionary(),
+				transforms: getTransforms(),
+				hash_table: make([]uint16, 1<<15),
+				buckets:    make([]uint16, 1<<kDictNumBits),
+				dict_words: make([]dictWord, 1),
+			}
+		} else if d.words[0] == getDictionary() && d.transforms[0] == getTransforms() {
+			initEncoderDictionary(&d.encoder)
+		} else {
+			buildEncoderDictionary(&d.encoder, d.words[0], d.transforms[0])
+		}
+	})
+	return &d.encoder
+}
+
+/* Picks the words and transforms for a dictionary reference of length |len|
+   at |address|. */
+func (d *SharedDictionary) lookup(length int, address int, p1 byte, p2 byte, lut contextLUT) (*dictionary, *transforms, int) {
+	if d.context_based {
+		id := d.context_map[getContext(p1, p2, lut)]
+		return d.words[id], d.transforms[id], address
+	}
+
+	/* If the distance is out of bound, select the next static dictionary if
+	   there are several. */
+	for id := range d.words {
+		var words *dictionary = d.words[id]
+		var trans *transforms = d.transforms[id]
+		var shift byte = words.size_bits_by_length[length]
+		var count int = 0
+		if shift != 0 {
+			count = int(trans.num_transforms) << shift
+		}
+		if address < count || id == len(d.words)-1 {
+			return words, trans, address
+		}
+		address -= count
+	}
+	return nil, nil, 0
+}
+
+type sharedDictionaryParser struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (p *sharedDictionaryParser) bytes(n int) []byte {
+	if p.err != nil || n > len(p.data)-p.pos {
+		p.err = errSharedDictionaryFormat
+		return nil
+	}
+	b := p.data[p.pos : p.pos+n : p.pos+n]
+	p.pos += n
+	return b
+}
+
+func (p *sharedDictionaryParser) next() byte {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *sharedDictionaryParser) varint() uint64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(p.data[p.pos:])
+	if n <= 0 {
+		p.err = errSharedDictionaryFormat
+		return 0
+	}
+	p.pos += n
+	return v
+}
+
+func (p *sharedDictionaryParser) wordList(w *dictionary) {
+	copy(w.size_bits_by_length[minDictionaryWordLength:], p.bytes(maxSharedDictionaryWordLength+1-minDictionaryWordLength))
+	for _, bits := range w.size_bits_by_length {
+		if bits > 15 {
+			p.err = errSharedDictionaryFormat
+		}
+	}
+	computeDictionaryOffsets(w)
+	w.data = p.bytes(int(w.data_size))
+}
+
+func (p *sharedDictionaryParser) transformList(t *transforms) {
+	size := p.bytes(2)
+	if size == nil {
+		return
+	}
+	t.prefix_suffix_size = binary.LittleEndian.Uint16(size)
+	t.prefix_suffix = p.bytes(int(t.prefix_suffix_size))
+	for pos := 0; pos < len(t.prefix_suffix); pos += 1 + int(t.prefix_suffix[pos]) {
+		t.prefix_suffix_map = append(t.prefix_suffix_map, uint16(pos))
+	}
+	if n := len(t.prefix_suffix_map); n > 256 || (n > 0 && int(t.prefix_suffix_map[n-1])+1+int(t.prefix_suffix[t.prefix_suffix_map[n-1]]) != len(t.prefix_suffix)) {
+		p.err = errSharedDictionaryFormat
+		return
+	}
+
+	t.num_transforms = uint32(p.next())
+	t.transforms = p.bytes(3 * int(t.num_transforms))
+	if p.err != nil {
+		return
+	}
+	has_params := false
+	for i := 0; i < int(t.num_transforms); i++ {
+		if int(transformPrefixId(t, i)) >= len(t.prefix_suffix_map) || int(transformSuffixId(t, i)) >= len(t.prefix_suffix_map) || transformType(t, i) >= numTransformTypes {
+			p.err = errSharedDictionaryFormat
+			return
+		}
+		if transformType(t, i) == transformShiftFirst || transformType(t, i) == transformShiftAll {
+			has_params = true
+		}
+	}
+	if has_params {
+		t.params = p.bytes(2 * int(t.num_transforms))
+	}
+	computeCutoffTransforms(t)
+}
+
+/* Finds, for each cut 0..9, the first transform that omits that many last
+   bytes without adding a prefix or suffix. */
+func computeCutoffTransforms(t *transforms) {
+	for cut := range t.cutOffTransforms {
+		t.cutOffTransforms[cut] = -1
+		for i := 0; i < int(t.num_transforms); i++ {
+			if int(transformType(t, i)) == cut && transformPrefix(t, i)[0] == 0 && transformSuffix(t, i)[0] == 0 {
+				t.cutOffTransforms[cut] = int16(i)
+				break
+			}
+		}
+	}
+}
+
+/* Builds the encoder hash tables for a custom word list and transforms.
+   Only words that are matched verbatim (possibly cut) are indexed, and only
+   the first 2048 words of each length can be found by the hashers. */
+func buildEncoderDictionary(dict *encoderDictionary, words *dictionary, trans *transforms) {
+	dict.words = words
+	dict.transforms = trans
+
+	dict.cutoffTransformsCount = 0
+	dict.cutoffTransforms = 0
+	for cut := 0; cut <= transformsMaxCutOff; cut++ {
+		var id int = int(trans.cutOffTransforms[cut]) - cut<<2
+		if trans.cutOffTransforms[cut] < 0 || id < 0 || id > 0x3F {
+			break
+		}
+		dict.cutoffTransforms |= uint64(id) << uint(cut*6)
+		dict.cutoffTransformsCount++
+	}
+
+	type entry struct {
+		key uint32
+		w   dictWord
+	}
+	var entries []entry
+	dict.hash_table = make([]uint16, 1<<15)
+	for l := maxSharedDictionaryWordLength; l >= minDictionaryWordLength; l-- {
+		if words.size_bits_by_length[l] == 0 {
+			continue
+		}
+		for idx := 0; idx < 1<<words.size_bits_by_length[l]; idx++ {
+			offset := int(words.offsets_by_length[l]) + l*idx
+			word := words.data[offset : offset+l]
+			entries = append(entries, entry{hash(word), dictWord{byte(l), 0, uint16(idx)}})
+			if idx >= 2048 {
+				continue
+			}
+
+			/* Two slots per key, longest words first. */
+			key := hash14(word) << 1
+			if dict.hash_table[key] == 0 {
+				dict.hash_table[key] = uint16(l | idx<<5)
+			} else if dict.hash_table[key+1] == 0 {
+				dict.hash_table[key+1] = uint16(l | idx<<5)
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	dict.buckets = make([]uint16, 1<<kDictNumBits)
+	dict.dict_words = make([]dictWord, 1, len(entries)+1)
+	for i, e := range entries {
+		if i == 0 || entries[i-1].key != e.key {
+			if len(dict.dict_words) > 0xFFFF {
+				break
+			}
+			dict.buckets[e.key] = uint16(len(dict.dict_words))
+		}
+		if i+1 == len(entries) || entries[i+1].key != e.key {
+			/* The last word of a bucket is marked by the high bit of len. */
+			e.w.len |= 0x80
+		}
+		dict.dict_words = append(dict.dict_words, e.w)
+	}
+}
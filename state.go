@@ -89,9 +89,10 @@ const (
 )
 
 type Reader struct {
-	src io.Reader
-	buf []byte // scratch space for reading from src
-	in  []byte // current chunk to decode; usually aliases buf
+	src     io.Reader
+	options ReaderOptions
+	buf     []byte // scratch space for reading from src
+	in      []byte // current chunk to decode; usually aliases buf
 
 	state        int
 	loop_counter int
@@ -178,6 +179,23 @@ type Reader struct {
 	dictionary                  *dictionary
 	transforms                  *transforms
 	trivial_literal_contexts    [8]uint32
+	metadata                    []byte
+	custom_dict_size            int
+	memory_needed               int64
+	memory_limit                int64
+	total_in                    int64
+	total_out                   int64
+	stream_start                int64
+	stream_ended                bool
+	boundaries                  []StreamBoundary
+	exact                       bool
+	inspector                   *inspector
+	salvage_pos                 int64
+	salvaging                   bool
+	salvage_err                 error
+	damage                      []*SalvageError
+	unknown_history             int
+	resync_trial                *Reader
 }
 
 func decoderStateInit(s *Reader) bool {
@@ -199,6 +217,7 @@ func decoderStateInit(s *Reader) bool {
 	s.pos = 0
 	s.rb_roundtrips = 0
 	s.partial_pos_out = 0
+	s.custom_dict_size = 0
 
 	s.block_type_trees = nil
 	s.block_len_trees = nil
@@ -243,6 +262,9 @@ func decoderStateInit(s *Reader) bool {
 	s.dictionary = getDictionary()
 	s.transforms = getTransforms()
 
+	s.salvage_pos = 0
+	s.unknown_history = historyKnown
+
 	return true
 }
 
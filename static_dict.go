@@ -73,6 +73,9 @@ func isMatch(d *dictionary, w dictWord, data []byte, max_length uint) bool {
 
 func findAllStaticDictionaryMatches(dict *encoderDictionary, data []byte, min_length uint, max_length uint, matches []uint32) bool {
 	var has_found_match bool = false
+	if dict.transforms != getTransforms() {
+		return findAllCutoffDictionaryMatches(dict, data, min_length, max_length, matches)
+	}
 	{
 		var offset uint = uint(dict.buckets[hash(data)])
 		var end bool = offset == 0
@@ -660,3 +663,36 @@ func findAllStaticDictionaryMatches(dict *encoderDictionary, data []byte, min_le
 
 	return has_found_match
 }
+
+/* Variant of findAllStaticDictionaryMatches for custom transforms: only the
+   identity and "omit last" transforms without prefix or suffix are known. */
+func findAllCutoffDictionaryMatches(dict *encoderDictionary, data []byte, min_length uint, max_length uint, matches []uint32) bool {
+	var has_found_match bool = false
+	var offset uint = uint(dict.buckets[hash(data)])
+	var end bool = offset == 0
+	for !end {
+		w := dict.dict_words[offset]
+		offset++
+		var l uint = uint(w.len) & 0x1F
+		var n uint = uint(1) << dict.words.size_bits_by_length[l]
+		var id uint = uint(w.idx)
+		end = !(w.len&0x80 == 0)
+		if w.transform != 0 {
+			continue
+		}
+
+		var matchlen uint = dictMatchLength(dict.words, data, id, l, max_length)
+		var len uint
+		for len = brotli_max_size_t(min_length, 1); len <= matchlen; len++ {
+			var cut uint = l - len
+			if cut >= uint(dict.cutoffTransformsCount) {
+				continue
+			}
+			var transform_id uint = (cut << 2) + uint((dict.cutoffTransforms>>(cut*6))&0x3F)
+			addMatch(id+transform_id*n, len, l, matches)
+			has_found_match = true
+		}
+	}
+
+	return has_found_match
+}
@@ -0,0 +1,82 @@
+package brotli
+
+import "time"
+
+// WriterStats reports what a Writer has done since it was created or
+// Reset, as returned by Writer.Stats.
+type WriterStats struct {
+	// BytesIn is the number of bytes written to the Writer, not counting
+	// metadata, and BytesOut the number of compressed bytes it has written
+	// to its destination.
+	BytesIn  int64
+	BytesOut int64
+	// NumMetablocks is the number of metablocks the Writer has produced,
+	// including metadata blocks and the empty ones that Flush adds to end
+	// the output on a byte boundary.
+	NumMetablocks int
+	// Duration is the time spent in Write, Flush, Close and the other
+	// methods that encode, not counting the time spent reading in ReadFrom.
+	Duration time.Duration
+	// Metablocks describes each metablock, in order, if
+	// WriterOptions.KeepMetablockStats is set.
+	Metablocks []MetablockStats
+}
+
+// MetablockStats describes a metablock produced by a Writer.
+//
+// At qualities 0 and 1, the encoder compresses a block of input at a time
+// without reporting how; each MetablockStats then describes such a block,
+// which may take more than one metablock, and only its sizes, Last and
+// Duration are set.
+type MetablockStats struct {
+	// UncompressedSize is the number of bytes of input in the metablock.
+	UncompressedSize int
+	// CompressedBits is the size of the metablock, header included, in
+	// the compressed stream. For the last metablock, it includes the
+	// padding that ends the stream on a byte boundary.
+	CompressedBits int64
+	// MetadataSize is the length of the metadata of a metadata block.
+	MetadataSize int
+
+	Last         bool
+	Uncompressed bool
+	Metadata     bool
+
+	// Duration is the time spent encoding the metablock, from finding
+	// backward references in its input to storing it.
+	Duration time.Duration
+
+	// The rest is only set for compressed metablocks.
+
+	// Commands is the number of commands, and Literals the number of
+	// literals they insert.
+	Commands int
+	Literals int
+	// ContextMode is the literal context mode chosen for the metablock.
+	ContextMode ContextMode
+	// NumBlockTypes holds the number of literal, insert-and-copy and
+	// distance block types.
+	NumBlockTypes [3]int
+	// NumHistograms holds the number of literal, insert-and-copy and
+	// distance histograms left after clustering; each is stored as a
+	// Huffman tree.
+	NumHistograms [3]int
+}
+
+// Stats returns statistics about the work the Writer has done since it was
+// created or Reset.
+func (w *Writer) Stats() WriterStats {
+	var stats WriterStats = w.stats_
+	stats.BytesOut = w.total_out_
+	stats.Metablocks = stats.Metablocks[:len(stats.Metablocks):len(stats.Metablocks)]
+	return stats
+}
+
+/* Counts a metablock that has been written, and keeps |info| if the
+   options ask for it. */
+func recordMetablock(s *Writer, info *MetablockStats) {
+	s.stats_.NumMetablocks++
+	if s.options.KeepMetablockStats {
+		s.stats_.Metablocks = append(s.stats_.Metablocks, *info)
+	}
+}
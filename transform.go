@@ -590,6 +590,9 @@ func transformDictionaryWord(dst []byte, word []byte, len int, trans *transforms
 			len -= t
 		} else if t >= transformOmitFirst1 && t <= transformOmitFirst9 {
 			var skip int = t - (transformOmitFirst1 - 1)
+			if skip > len {
+				skip = len
+			}
 			word = word[skip:]
 			len -= skip
 		}
@@ -3,7 +3,10 @@ package brotli
 import (
 	"errors"
 	"io"
+	"math"
+	"time"
 
+	"github.com/qydysky/brotli/internal/readersize"
 	"github.com/qydysky/brotli/matchfinder"
 )
 
@@ -13,19 +16,101 @@ const (
 	DefaultCompression = 6
 )
 
+// Encoder modes, for use in WriterOptions.Mode.
+const (
+	// ModeGeneric makes no assumptions about the input.
+	ModeGeneric = modeGeneric
+	// ModeText declares UTF-8 formatted text. As in the reference encoder,
+	// it currently compresses the same as ModeGeneric: literal context
+	// modeling is chosen from the data itself.
+	ModeText = modeText
+	// ModeFont tunes the encoder for WOFF 2.0 font data.
+	ModeFont = modeFont
+	// ModeAuto chooses between the other modes by examining the first
+	// block of input, so that font data is compressed as with ModeFont.
+	ModeAuto = modeAuto
+)
+
 // WriterOptions configures Writer.
 type WriterOptions struct {
 	// Quality controls the compression-speed vs compression-density trade-offs.
 	// The higher the quality, the slower the compression. Range is 0 to 11.
 	Quality int
 	// LGWin is the base 2 logarithm of the sliding window size.
-	// Range is 10 to 24. 0 indicates automatic configuration based on Quality.
+	// Range is 10 to 24 (30 with LargeWindow). 0 indicates automatic
+	// configuration based on Quality.
 	LGWin int
+	// LargeWindow enables "Large Window Brotli", which allows LGWin up to 30.
+	// The resulting stream is not RFC 7932 compliant; it can only be decoded
+	// by a Reader with ReaderOptions.LargeWindow set.
+	// It has no effect at qualities below 3.
+	LargeWindow bool
+	// Mode tells the encoder what kind of data to expect. Only ModeFont,
+	// given or detected by ModeAuto, changes the output: at qualities 4 and
+	// above it selects distance parameters suited to fonts, unless NPostfix
+	// or NDirect is set. The default is ModeGeneric.
+	Mode int
+	// SizeHint is the expected total size of the input, in bytes. The encoder
+	// uses it to choose its hashing strategy and context modeling. 0 means
+	// unknown; the encoder then estimates the size from the first block of
+	// input. A negative SizeHint makes Write and Close fail.
+	SizeHint int64
+	// LGBlock is the base 2 logarithm of the input block size. The encoder
+	// buffers this much input before it analyzes it and decides whether to
+	// emit a metablock. Larger blocks give better block splitting at high
+	// qualities; smaller blocks make compressed output available sooner.
+	// Flush always emits all buffered input, whatever the block size.
+	// Range is 16 to 24. 0 indicates automatic configuration based on Quality.
+	// Other values make Write, Flush and Close fail.
+	// It is ignored at qualities below 4, which use fixed block sizes.
+	LGBlock int
+	// DisableLiteralContextModeling makes the encoder use a single literal
+	// histogram per block type instead of modeling literals by context.
+	// This gives up some compression in exchange for faster decoding.
+	DisableLiteralContextModeling bool
+
+	// NPostfix and NDirect set the distance parameters NPOSTFIX and NDIRECT
+	// (RFC 7932, section 4). Data made of fixed-size records often compresses
+	// better when 1<<NPostfix matches the record size. NPostfix ranges from
+	// 0 to 3; NDirect must be a multiple of 1<<NPostfix, at most 15<<NPostfix.
+	// Other values make Write, Flush and Close fail.
+	// They are ignored at qualities below 4.
+	NPostfix int
+	NDirect  int
+	// SearchDistanceParams makes the encoder try all distance parameters for
+	// each metablock and keep the cheapest, starting from NPostfix and
+	// NDirect. Qualities 10 and 11 always do this.
+	SearchDistanceParams bool
+	// Dictionary is a raw prefix dictionary: data that the encoder treats as
+	// if it had been written just before the start of the stream, so that
+	// back-references can reach into it. It is not included in the output.
+	// Only the last window-size minus 16 bytes are used (see LGWin), and
+	// it is ignored at qualities 0 and 1.
+	// The stream can only be decoded by a Reader with the same
+	// ReaderOptions.Dictionary.
+	Dictionary []byte
+	// SharedDictionary, if not nil, is a Shared Brotli dictionary whose
+	// prefix is used like Dictionary and whose first word list and
+	// transforms replace the RFC 7932 static dictionary. Its prefix may not be
+	// combined with Dictionary.
+	// The stream can only be decoded by a Reader with the same
+	// ReaderOptions.SharedDictionary.
+	SharedDictionary *SharedDictionary
+
+	// KeepMetablockStats makes the Writer keep a description of each
+	// metablock it produces, which Stats reports. It is off by default, as
+	// a long stream that is flushed often has many metablocks.
+	KeepMetablockStats bool
 }
 
 var (
-	errEncode       = errors.New("brotli: encode error")
-	errWriterClosed = errors.New("brotli: Writer is closed")
+	errEncode           = errors.New("brotli: encode error")
+	errWriterClosed     = errors.New("brotli: Writer is closed")
+	errWriterStarted    = errors.New("brotli: Writer has already started encoding")
+	errNegativeSizeHint = errors.New("brotli: negative size hint")
+	errInvalidLGBlock   = errors.New("brotli: LGBlock out of range")
+	errInvalidDistance  = errors.New("brotli: invalid NPostfix or NDirect")
+	errMetadataTooLarge = errors.New("brotli: metadata block larger than 16 MiB")
 )
 
 // Writes to the returned writer are compressed and written to dst.
@@ -59,11 +144,56 @@ func NewWriterOptions(dst io.Writer, options WriterOptions) *Writer {
 func (w *Writer) Reset(dst io.Writer) {
 	encoderInitState(w)
 	w.params.quality = w.options.Quality
+	w.params.mode = w.options.Mode
+	w.params.large_window = w.options.LargeWindow
 	if w.options.LGWin > 0 {
 		w.params.lgwin = uint(w.options.LGWin)
 	}
+	w.params.lgblock = w.options.LGBlock
+	w.params.disable_literal_context_modeling = w.options.DisableLiteralContextModeling
+	w.params.search_distance_params = w.options.SearchDistanceParams
+	w.params.dist.distance_postfix_bits = uint32(w.options.NPostfix)
+	w.params.dist.num_direct_distance_codes = uint32(w.options.NDirect)
 	w.dst = dst
 	w.err = nil
+	if w.options.SizeHint < 0 {
+		w.err = errNegativeSizeHint
+	} else if w.options.SizeHint > 0 {
+		w.params.size_hint = clampSizeHint(uint64(w.options.SizeHint))
+	}
+	if w.options.LGBlock != 0 && (w.options.LGBlock < minInputBlockBits || w.options.LGBlock > maxInputBlockBits) {
+		w.err = errInvalidLGBlock
+	}
+	if !validDistanceParams(w.options.NPostfix, w.options.NDirect) {
+		w.err = errInvalidDistance
+	}
+	if shared := w.options.SharedDictionary; shared != nil {
+		w.params.dictionary = *shared.encoderDictionary()
+		if len(shared.prefix) != 0 && len(w.options.Dictionary) != 0 {
+			w.err = errDictionaryConflict
+		}
+	}
+}
+
+func validDistanceParams(npostfix, ndirect int) bool {
+	if npostfix < 0 || npostfix > maxNpostfix || ndirect < 0 {
+		return false
+	}
+	return ndirect>>npostfix <= 15 && (ndirect>>npostfix)<<npostfix == ndirect
+}
+
+// SetSizeHint declares the total size of the input that will be written.
+// It must be called before the first Write, and it overrides
+// WriterOptions.SizeHint until the next Reset.
+func (w *Writer) SetSizeHint(size int64) error {
+	if size < 0 {
+		return errNegativeSizeHint
+	}
+	if w.is_initialized_ {
+		return errWriterStarted
+	}
+	w.params.size_hint = clampSizeHint(uint64(size))
+	return nil
 }
 
 func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
@@ -74,6 +204,10 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 		return 0, w.err
 	}
 
+	start := time.Now()
+	defer func() {
+		w.stats_.Duration += time.Since(start)
+	}()
 	for {
 		availableIn := uint(len(p))
 		nextIn := p
@@ -81,6 +215,9 @@ func (w *Writer) writeChunk(p []byte, op int) (n int, err error) {
 		bytesConsumed := len(p) - int(availableIn)
 		p = p[bytesConsumed:]
 		n += bytesConsumed
+		if op != operationEmitMetadata {
+			w.stats_.BytesIn += int64(bytesConsumed)
+		}
 		if !success {
 			return n, errEncode
 		}
@@ -100,6 +237,46 @@ func (w *Writer) Flush() error {
 	return err
 }
 
+// FullFlush is like Flush, but it also makes the rest of the stream
+// independent of the data before it. Later data does not refer back past
+// this point, and its encoding depends on no other decoder state that
+// would be carried over. A decoder that has lost earlier parts of the
+// stream can start at the restart point that FullFlush creates, as a
+// Reader with ReaderOptions.Resync does. RestartPoints reports where the
+// restart points are.
+// FullFlush costs more compression than Flush. The next two bytes are
+// stored uncompressed, and no static dictionary references are made for
+// a window's worth of data after the restart point.
+func (w *Writer) FullFlush() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	encoderRestart(w)
+	return nil
+}
+
+// RestartPoints returns the offsets in the compressed stream of the restart
+// points created by FullFlush since the Writer was created or Reset: the
+// number of bytes written to dst before each.
+func (w *Writer) RestartPoints() []int64 {
+	return w.restart_points_
+}
+
+// MaxMetadataSize is the largest payload that WriteMetadata accepts.
+const MaxMetadataSize = 1 << 24
+
+// WriteMetadata writes p to the stream as a metadata block. Metadata blocks
+// are skipped by decoders, so they do not change the decoded output.
+// All data passed to Write is flushed before the metadata block, as by Flush.
+// p must be no longer than MaxMetadataSize.
+func (w *Writer) WriteMetadata(p []byte) error {
+	if len(p) > MaxMetadataSize {
+		return errMetadataTooLarge
+	}
+	_, err := w.writeChunk(p, operationEmitMetadata)
+	return err
+}
+
 // Close flushes remaining data to the decorated writer.
 func (w *Writer) Close() error {
 	// If stream is already closed, it is reported by `writeChunk`.
@@ -114,6 +291,80 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return w.writeChunk(p, operationProcess)
 }
 
+// ReadFrom implements io.ReaderFrom. It reads from r until EOF or an
+// error, straight into the encoder's window, where Write would copy the data
+// from the buffer that io.Copy had read it into. If r can tell how much data
+// it holds, as files, bytes.Reader and io.LimitedReader can, that becomes
+// the size hint of a stream that has not started yet. As with Write, Flush
+// or Close must be called to ensure that the encoded bytes are written.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	size, sized := readersize.Remaining(r)
+	if sized && !w.is_initialized_ && w.params.size_hint == 0 {
+		w.params.size_hint = clampSizeHint(uint64(size))
+	}
+
+	for {
+		/* Compress the current input block if it is full. The first call
+		   also initializes the encoder. */
+		if _, err := w.writeChunk(nil, operationProcess); err != nil {
+			return n, err
+		}
+		if w.params.quality == fastOnePassCompressionQuality || w.params.quality == fastTwoPassCompressionQuality {
+			m, err := w.readFromFast(r, size, sized)
+			return n + m, err
+		}
+		if w.stream_state_ != streamProcessing {
+			return n, errEncode
+		}
+
+		/* Asking for a byte more than r is expected to hold finds its end
+		   without making room for more. */
+		var max_size uint = math.MaxUint32
+		if sized && size-n < int64(max_size) {
+			max_size = uint(size-n) + 1
+		}
+		m, err := r.Read(inputSpaceInRingBuffer(w, max_size))
+		commitInputToRingBuffer(w, uint(m))
+		n += int64(m)
+		w.stats_.BytesIn += int64(m)
+		if size-n < 0 {
+			sized = false
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+/* ReadFrom for the fast qualities, which compress their input in place:
+   the input is gathered in a buffer as large as the blocks the two-pass
+   compressor works on, and compressed with Write. */
+func (w *Writer) readFromFast(r io.Reader, size int64, sized bool) (n int64, err error) {
+	var buf_size int64 = int64(brotli_min_size_t(kCompressFragmentTwoPassBlockSize, uint(1)<<w.params.lgwin))
+	if sized && size < buf_size {
+		buf_size = size + 1
+	}
+	buf := make([]byte, buf_size)
+	for {
+		m, err := io.ReadFull(r, buf)
+		if m != 0 {
+			if _, err := w.Write(buf[:m]); err != nil {
+				return n, err
+			}
+			n += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 type nopCloser struct {
 	io.Writer
 }